@@ -5,101 +5,80 @@ import (
 	"os/signal"
 	"syscall"
 	"bufio"
-	"io/ioutil"
 	"fmt"
 	"log"
 	"strings"
-	"path/filepath"
-	"net"
 	"mob/proto"
+	"mob/peer"
 	"mob/client/music"
-	"github.com/tcolgate/mp3"
-	"github.com/cenkalti/rpc2"
-	"github.com/veandco/go-sdl2/sdl"
-	"github.com/veandco/go-sdl2/sdl_mixer"
+	"flag"
+	"text/tabwriter"
+	"strconv"
 	"time"
-	"sync"
-	"unsafe"
 )
 
-// SDL music ptr
-var m *mix.Music
+// Our mob peer; the shell drives it
+var p *peer.Peer
 
-// TCP and RPC handlers for the tracker
-var trackerConn net.Conn
-var client *rpc2.Client
+// What the last search found, for play #n
+var results []proto.Song
 
-// UDP handler for handshake packets
-var packetConn net.PacketConn
-
-// UDP handler for mp3 frames
-var mp3Conn net.PacketConn
-
-// This client's local IP address
-var publicIp string
-
-// Control flags
-var connectedToTracker bool // did join a tracker
-var isSeeder bool           // tells us if we have access to the mp3 or not
-var alreadySeeding bool     // prevent tracker rpc from being over called
-var alreadyListeningForMp3 bool
-var isSourceSeeder bool
-
-// Seeder's data structures
-var peerToSeedees map[string]net.Conn // map of seedees to their udp conn struct
-var peerToConn map[string]bool // map of seedees to a boolean if they responded to our request or not
-var seedees []string // list of seedees
-
-var currentSong string // the current song playing
+func main() {
+	sinkKind := flag.String("sink", "sdl", "where to play audio: sdl, null, wav or pcm")
+	sinkOut := flag.String("out", ".", "directory the wav sink records songs to")
+
+	cfg := peer.DefaultConfig()
+	flag.StringVar(&cfg.Id, "id", cfg.Id, "who you are to the tracker, so your queued songs stay yours when you rejoin; random if empty")
+	flag.StringVar(&cfg.Ip, "bind", cfg.Ip, "ip address to use; picked from our network interfaces if empty")
+	flag.StringVar(&cfg.Interface, "interface", cfg.Interface, "network interface to pick our ip address from, i.e. eth0")
+	flag.DurationVar(&cfg.ScanInterval, "scan", cfg.ScanInterval, "how often to look for songs added to or removed from ../songs (0 never)")
+	flag.IntVar(&cfg.HandshakePort, "handshake-port", cfg.HandshakePort, "udp port for handshake packets (0 picks a free one)")
+	flag.IntVar(&cfg.MediaPort, "media-port", cfg.MediaPort, "udp port for mp3 frames (0 picks a free one)")
+	flag.IntVar(&cfg.BufferFrames, "buffer", cfg.BufferFrames, "max mp3 frames buffered ahead of playback")
+	flag.Float64Var(&cfg.Pace, "pace", cfg.Pace, "stream to seedees at this multiple of real-time (0 is unpaced)")
+	flag.DurationVar(&cfg.Burst, "burst", cfg.Burst, "audio that may be streamed to a seedee back to back")
+	flag.DurationVar(&cfg.Drift, "drift", cfg.Drift, "correct playback drifting further than this from the other peers")
+	flag.BoolVar(&cfg.Nacks, "nack", cfg.Nacks, "request retransmission of lost mp3 frames")
+	flag.IntVar(&cfg.FEC, "fec", cfg.FEC, "when seeding, send one parity packet per this many frames (0 disables)")
+	flag.Parse()
+
+	// Initialize the audio sink
+	sink, err := music.NewSink(*sinkKind, *sinkOut)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-var maxSeedees int
-var mux sync.Mutex // prevent data races with read/writes to peerToSeedees
+	// The pcm sink owns stdout; move the shell over to stderr
+	if *sinkKind == "pcm" {
+		os.Stdout = os.Stderr
+	}
 
-// Assume mp3 is no larger than 20MB. We reuse this buffer for each song we play.
-// Don't need to worry when it gets GCed since we're using it the whole time
-// TODO: figure out by songs < 20MB can still overwite this on only some machines
-var songBuf [20 * 1024 * 1024]byte
+	player := music.NewPlayer(sink)
+	defer player.Close()
 
-func main() {
 	// Handle kill signal gracefully
 	c := make(chan os.Signal, 2)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-c
-		if connectedToTracker {
-			handleLeave()
-		}
+		handleLeave()
 
-		defer music.Quit()
+		player.Close()
 		os.Exit(1)
 	}()
 
-	// Initialize SDL audio
-	music.Init()
-	defer music.Quit()
-
 	// Get our local network IP address
-	var ipErr error
-	publicIp, ipErr = proto.GetLocalIp()
-	if ipErr != nil {
-		log.Fatal("Error: not connected to the internet.")
-		os.Exit(1)
+	if cfg.Ip == "" {
+		var ipErr error
+		cfg.Ip, ipErr = proto.GetLocalIp(cfg.Interface)
+		if ipErr != nil {
+			log.Fatal(ipErr)
+		}
 	}
 
-	// Set max number of seedees to our stream to prevent congestion on peers
-	maxSeedees = 1
-
-	// Init globals
-	m = nil
-	seedees = make([]string, 0)
-	peerToConn = make(map[string]bool)
-	peerToSeedees = make(map[string]net.Conn)
-	connectedToTracker = false
-	isSeeder = false
-	isSourceSeeder = false
-	alreadySeeding = false
-	alreadyListeningForMp3 = false
-	currentSong = ""
+	cfg.Player = player
+	p = peer.New(cfg)
+	go watchEvents()
 
 	// Start the shell
 	fmt.Print(
@@ -124,458 +103,387 @@ func main() {
 
 		strs := strings.Split(input, " ")
 		switch strs[0] {
-		case "join": // join 192.168.1.12:1234
-			handleJoin(strs[1])
+		case "join": // join 192.168.1.12:1234, or join the one tracker around
+			if len(strs) > 1 {
+				handleJoin(strs[1])
+			} else {
+				handleJoinDiscovered()
+			}
+		case "discover": // list trackers on the local network
+			handleDiscover()
 		case "leave": // leave the network
 			handleLeave()
 		case "list-songs": // list
 			handleListSongs()
+		case "search": // search artist:vivaldi duration:<5m
+			handleSearch(strings.TrimSpace(strings.TrimPrefix(input, strs[0])))
 		case "list-peers":
 			handleListPeers()
-		case "play": // play blah.mp3
-			handlePlay(strs[1])
+		case "play": // play blah.mp3, or play #3 of the last search
+			handlePlay(strings.TrimSpace(strings.TrimPrefix(input, strs[0])))
+		case "queue": // show the current song and the songs up next
+			handleQueue()
+		case "remove": // remove 2
+			handleRemove(strs[1:])
+		case "move": // move 3 1
+			handleMove(strs[1:])
+		case "skip": // vote to skip the current song on every peer
+			handleSkip()
+		case "upvote": // upvote 3
+			handleVote(strs[1:], true)
+		case "downvote": // downvote 3
+			handleVote(strs[1:], false)
+		case "clear": // drop every song up next we enqueued
+			handleClear()
 		case "quit": // quit the program
-			if connectedToTracker {
-				handleLeave()
-			}
+			handleLeave()
 			return
 		case "help": // help
 			handleHelp()
-		default:     // error message continue
+		default: // error message continue
 			fmt.Println("Error: not a valid command")
 		}
 	}
 }
 
-// Join a tracker node and register your rpcs that the tracker can call
+// Join a tracker node
 func handleJoin(input string) {
-	if connectedToTracker {
-		handleLeave()
-	}
+	handleLeave()
 
-	var err error
-	trackerConn, err = net.Dial("tcp", input)
-	if err != nil {
+	if err := p.Join(input); err != nil {
 		log.Println(err)
+		return
 	}
 
-	client = rpc2.NewClient(trackerConn)
-
-	// Register the rpc handlers for seedToPeers() so that tracker can notify
-	// client when to start seeding
-	client.Handle("seed", func(client *rpc2.Client, args *proto.TrackerRes, reply *proto.HandshakePacket) error {
-		if alreadySeeding {
-			return nil
-		}
-
-		// Start seeding
-		alreadySeeding = true
-		isSeeder = true
-		isSourceSeeder = true
-		currentSong = args.Res
-		go seedToPeers(currentSong)
-		return nil
-	})
-
-	// Let tracker notify client to start listening for mp3 frames
-	client.Handle("listen-for-mp3", func(client *rpc2.Client, args *proto.TrackerRes, reply *proto.HandshakePacket) error {
-		if alreadyListeningForMp3 {
-			return nil
-		}
-
-		alreadyListeningForMp3 = true
-		go listenForMp3()
-		return nil
-	})
-
-	// Let tracker notify client to start playing
-	client.Handle("start-playing", func(client *rpc2.Client, args *proto.TimePacket, reply *proto.HandshakePacket) error {
-		// Load song from in-memory buffer so that it can be played by SDL
-		// sort of a hack by casting pointer to golang array to C void *
-		ptrToBuf := sdl.RWFromMem(unsafe.Pointer(&(songBuf)[0]), cap(songBuf))
-		m, _ = mix.LoadMUS_RW(ptrToBuf, 0)
-
+	fmt.Println("Joining tracker " + input)
+}
 
-		m.Play(1) // Start playing
-		for mix.PlayingMusic() {
-			time.Sleep(5 * time.Millisecond) // block; cpu friendly
-		}
+// Join the tracker on our network, if there is exactly one
+func handleJoinDiscovered() {
+	trackers, err := p.Discover(peer.DefaultDiscoverTimeout)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
 
-		handleDonePlaying()
-		return nil
-	})
+	switch len(trackers) {
+	case 0:
+		fmt.Println("Error: found no trackers; try join <ip:port>")
+	case 1:
+		handleJoin(trackers[0].Addr)
+	default:
+		fmt.Println("Error: found several trackers; pick one with join <ip:port>")
+		printTrackers(trackers)
+	}
+}
 
-	go client.Run()
+// List the trackers on our network
+func handleDiscover() {
+	trackers, err := p.Discover(peer.DefaultDiscoverTimeout)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
 
-	connectedToTracker = true
+	if len(trackers) == 0 {
+		fmt.Println("No trackers found")
+		return
+	}
 
-	go listenForPeers() // begin handling incoming handshake requests
-	go handlePing()     // begin continuous communication with tracker
+	printTrackers(trackers)
+}
 
-	_, port, _ := net.SplitHostPort(trackerConn.LocalAddr().String())
-	client.Call("join", proto.ClientInfoMsg{net.JoinHostPort(publicIp, port), getSongNames()}, nil)
-	fmt.Println("Joining tracker " + input)
+func printTrackers(trackers []peer.TrackerInfo) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "TRACKER\tADDRESS\tPEERS")
+	for _, info := range trackers {
+		fmt.Fprintf(w, "%s\t%s\t%d\n", info.Name, info.Addr, info.Peers)
+	}
+	w.Flush()
 }
 
 // Leave the current tracker
 func handleLeave() {
-	if !connectedToTracker {
+	if !p.Joined() {
 		return
 	}
 
-	if m != nil {
-		mix.HaltMusic()
-	}
-
-	client.Call("leave", proto.ClientInfoMsg{trackerConn.LocalAddr().String(), nil}, nil)
-	connectedToTracker = false
-
 	fmt.Println("Leaving the tracker in 3 sec ...")
-	time.Sleep(3 * time.Second)
-	packetConn.Close()
+	p.Leave()
 	fmt.Println("done")
 }
 
 // Get song list from tracker
 func handleListSongs() {
-	if !connectedToTracker {
-		fmt.Println("Error: not connected to a tracker")
+	songs, err := p.ListSongs()
+	if err != nil {
+		fmt.Println("Error:", err)
 		return
 	}
 
-	var res proto.TrackerSlice
-	client.Call("list-songs", proto.ClientCmdMsg{""}, &res)
-	fmt.Println(res.Res)
+	printSongs(songs, false, nil, nil)
 }
 
-// Get list of peers from tracker
-func handleListPeers() {
-	if !connectedToTracker {
-		fmt.Println("Error: not connected to a tracker")
+// Search the tracker's catalog and number the results for play #n
+func handleSearch(query string) {
+	songs, err := p.Search(query)
+	if err != nil {
+		fmt.Println("Error:", err)
 		return
 	}
 
-	var res proto.TrackerSlice
-	client.Call("list-peers", proto.ClientCmdMsg{""}, &res)
-	fmt.Println(res.Res)
-}
-
-// Notify the tracker to add the given song to its song queue
-func handlePlay(input string) {
-	if !connectedToTracker {
-		fmt.Println("Error: not connected to a tracker")
+	results = songs
+	if len(songs) == 0 {
+		fmt.Println("No songs found")
 		return
 	}
 
-	client.Call("play", proto.ClientCmdMsg{input}, nil)
-	fmt.Println("Enqueued " + input)
+	printSongs(songs, true, nil, nil)
 }
 
-// Print shell commands
-func handleHelp() {
-	fmt.Print(
-		`commands:
-    join  - connect to a tracker
-    leave - disconnect from a tracker
-    list-songs - list all available songs
-    list-peers - list all peers on the network
-    play - enqueue a song to be played
-    help - show commands
-    quit - exit the program
-`)
-}
-
-// Method of continous communication between clients and tracker
-// Client constantly asking the tracker if the next song is ready.
-// TODO: use this as a method of timing out clients that have poor connectivity
-func handlePing() {
-	_, port, _ := net.SplitHostPort(trackerConn.LocalAddr().String())
-	for connectedToTracker {
-		client.Call("ping", proto.ClientInfoMsg{net.JoinHostPort(publicIp, port), nil}, nil)
-		time.Sleep(10 * time.Millisecond)
+// Print a table of songs. Different songs with the same file name are told
+// apart by their hash. Scores, if any, are the songs' votes and owners the
+// peers that enqueued them.
+func printSongs(songs []proto.Song, numbered bool, scores []int, owners []string) {
+	names := make(map[string]int)
+	for _, song := range songs {
+		names[song.Name]++
 	}
-}
 
-// Notify the client that we finished playing the song
-func handleDonePlaying() {
-	m.Free()
-	m = nil
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	if numbered {
+		fmt.Fprint(w, "#\t")
+	}
+	if scores != nil {
+		fmt.Fprint(w, "VOTES\t")
+	}
+	fmt.Fprint(w, "TITLE\tARTIST\tALBUM\tLENGTH\tBITRATE\tFILE")
+	if owners != nil {
+		fmt.Fprint(w, "\tQUEUED BY")
+	}
+	fmt.Fprintln(w)
+	for i, song := range songs {
+		file := song.Name
+		if names[song.Name] > 1 {
+			file += " (" + song.ShortHash() + ")"
+		}
 
-	// clean up connections
-	for _, c := range peerToSeedees {
-		c.Close()
+		if numbered {
+			fmt.Fprintf(w, "%d\t", i+1)
+		}
+		if scores != nil {
+			fmt.Fprintf(w, "%+d\t", scores[i])
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d kbps\t%s", orDash(song.Title), orDash(song.Artist), orDash(song.Album),
+			formatDuration(song.Duration), song.Bitrate, file)
+		if owners != nil {
+			fmt.Fprintf(w, "\t%s", owners[i])
+		}
+		fmt.Fprintln(w)
 	}
+	w.Flush()
+}
 
-	if !isSourceSeeder {
-		mp3Conn.Close()
+func orDash(s string) string {
+	if s == "" {
+		return "-"
 	}
 
-	peerToSeedees = make(map[string]net.Conn)
-	peerToConn = make(map[string]bool)
-	seedees = make([]string, 0)
-	isSeeder = false
-	isSourceSeeder = false
-	alreadySeeding = false
-	alreadyListeningForMp3 = false
-	currentSong = ""
+	return s
+}
 
-	// make rpc call to tracker
-	client.Call("done-playing", proto.ClientCmdMsg{""}, nil)
+// i.e. 3:07
+func formatDuration(d time.Duration) string {
+	s := int(d.Round(time.Second) / time.Second)
+	return fmt.Sprintf("%d:%02d", s/60, s%60)
 }
 
-// Call this if we're not a source seeder (has song locally) after we set our seedees
-func listenForMp3() {
-	// listen to incoming udp packets
-	var err error
-	mp3Conn, err = net.ListenPacket("udp", net.JoinHostPort(publicIp, "6122"))
+// Get list of peers from tracker
+func handleListPeers() {
+	peers, err := p.ListPeers()
 	if err != nil {
-		log.Fatal(err)
+		fmt.Println("Error:", err)
+		return
 	}
 
-	prebufferedFrames := 1
-	currIndex := 0
-
-	seeder := ""
-
-	// Continously listen mp3 packets while connected to tracker
-	for connectedToTracker { // terminate when we leave a tracker
-		if prebufferedFrames == 300 { // pre-buffered 200 frames before playing
-			// send rpc to start playing
-			go client.Call("ready-to-play", proto.ClientCmdMsg{""}, nil)
-		}
-
-		buf := make([]byte, 2048)
-
-		// Read a packet
-		n, addr, err := mp3Conn.ReadFrom(buf) // block here
-		if err != nil {
-			break // this will happen when we close mp3Conn
-		}
-
-		seederIp, _, _ := net.SplitHostPort(addr.String())
-		if seeder == "" {
-			seeder = seederIp
-		}
-
-		if seederIp != seeder {
-			continue
-		}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "PEER\tCLOCK OFFSET\tRTT")
+	for _, info := range peers {
+		fmt.Fprintf(w, "%s\t%v\t%v\n", info.Addr, info.Offset, info.RTT)
+	}
+	w.Flush()
+}
 
-		for _, c := range peerToSeedees {
-			c.Write(buf)
-			time.Sleep(300 * time.Microsecond)
+// Notify the tracker to add the given song to its song queue
+func handlePlay(input string) {
+	if strings.HasPrefix(input, "#") {
+		n, err := strconv.Atoi(input[1:])
+		if err != nil || n < 1 || n > len(results) {
+			fmt.Println("Error: no result " + input + " in the last search")
+			return
 		}
 
-		for i := 0; i < n; i++ {
-			songBuf[currIndex + i] = buf[i]
-		}
+		input = results[n-1].Hash
+	}
 
-		currIndex = currIndex + n
-		prebufferedFrames++
+	song, err := p.Enqueue(input)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
 	}
+
+	fmt.Println("Enqueued " + song.Name + " (" + song.ShortHash() + ")")
 }
 
-// Listens for udp request packets from peers in order to build the stream graph
-// Handles all possible handshake packets that will be sent to this peer.
-// Called in handleJoin when you join a tracker
-func listenForPeers() {
-	// listen to incoming udp packets
-	var err error
-	packetConn, err = net.ListenPacket("udp", net.JoinHostPort(publicIp, "6121"))
+// Show the current song and the songs up next, numbered for remove and move
+func handleQueue() {
+	queue, err := p.Queue()
 	if err != nil {
-		log.Fatal(err)
+		fmt.Println("Error:", err)
+		return
 	}
 
-	// Continously listen for handshake packets
-	// Eventually after a successful round of handshaking, all peers will
-	// be seeders and will block on the next ReadFrom() call until the next
-	// round
-	for connectedToTracker { // terminate when we leave a tracker
-		// Read a packet
-		buffer := make([]byte, 2048)
-		n, addr, e := packetConn.ReadFrom(buffer) // block here
-		if e != nil {
-			break
-		}
+	if current := queue.Current; current.Hash != "" {
+		fmt.Println("Now playing " + current.Name + " (" + current.ShortHash() + ")")
+	}
 
-		s := string(buffer[:n])
-		substrs := strings.Split(s, ":")
-		ip, _, _ := net.SplitHostPort(addr.String())
-		raddr := net.UDPAddr{IP: net.ParseIP(ip), Port: 6121}
+	if len(queue.Songs) == 0 {
+		fmt.Println("Nothing up next")
+		return
+	}
 
-		// Process the packet and handle
-		switch substrs[0] {
-		case "request": // where this client is a non-seeder
-			if currentSong == "" {
-				currentSong = substrs[1]
-			}
+	printSongs(queue.Songs, true, queue.Scores, queue.Owners)
+}
 
-			if isSeeder || hasSongLocally(substrs[1]) {
-				packetConn.WriteTo([]byte("reject"), &raddr)
-			} else {
-				packetConn.WriteTo([]byte("accept"), &raddr)
-			}
-		case "confirm": // where this client is a non-seeder
-			if isSeeder { // if we already confirmed, don't reject a confirm from our origin
-				go func() {
-					for i := 0; i < 5; i++ { // redundancy
-						packetConn.WriteTo([]byte("reject"), &raddr)
-						time.Sleep(500 * time.Microsecond)
-					}
-				}()
-			} else {
-				//originSeeder = ip
-				isSeeder = true
-				go seedToPeers(currentSong)
-			}
-		case "accept": // where this client is a seeder
-			if isSeeder && len(seedees) < maxSeedees {
-				ip, _, _ := net.SplitHostPort(addr.String())
-				seedees = append(seedees, ip)
-				go func() {
-					for i := 0; i < 5; i++ { // redundancy
-						packetConn.WriteTo([]byte("confirm"), &raddr)
-						time.Sleep(500 * time.Microsecond)
-					}
-				}()
-				mux.Lock()
-				peerToConn[ip] = true
-				mux.Unlock()
-			} else if isSeeder && len(seedees) >= maxSeedees {
-				mux.Lock()
-				peerToConn[ip] = true
-				mux.Unlock()
-			} else {
-				// is a non-seeder; shouldn't get here; sanity check
-				log.Fatal("non-seeder tried to accept other non-seeder")
-			}
-		case "reject": // where this client is a seeder
-			mux.Lock()
-			peerToConn[ip] = true
-			mux.Unlock()
-		}
+// Remove a song up next from the queue by its position
+func handleRemove(args []string) {
+	pos, ok := positions(args, 1)
+	if !ok {
+		fmt.Println("Error: usage: remove <position>")
+		return
 	}
-}
 
-// If this client has access to mp3 stream, find peers to stream to.
-// Broadcasts packets to peers until every peer has responded.
-// Called by tracker rpc.
-func seedToPeers(songFile string) {
-	var wg sync.WaitGroup
-
-	// Get list of peers from tracker
-	var peers proto.TrackerSlice
-	client.Call("list-peers", proto.ClientCmdMsg{""}, &peers)
-
-	peerToConn = make(map[string]bool)
-
-	// Loop to acquire udp connections to all other peers
-	for _, peer := range peers.Res {
-		ip, _, _ := net.SplitHostPort(peer)
-
-		if ip != publicIp { // check not this client
-			// Connect to an available peer
-			pc, _ := net.Dial("udp", net.JoinHostPort(ip, "6121"))
-			peerToConn[ip] = false
-
-			wg.Add(1)
-			// ARQ requests to the peer until we set its response bool to nil
-			go func() {
-				defer wg.Done()
-				defer pc.Close()
-				for {
-					mux.Lock()
-					if peerToConn[ip] {
-						mux.Unlock()
-						break
-					}
-					mux.Unlock()
-
-					pc.Write([]byte("request:" + songFile))
-					time.Sleep(500 * time.Microsecond)
-				}
-			}()
-		}
+	song, err := p.Remove(pos[0])
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
 	}
 
-	wg.Wait() // wait until we get a response from every peer
+	fmt.Println("Removed " + song.Name + " (" + song.ShortHash() + ")")
+}
 
+// Move a song up next to another position in the queue
+func handleMove(args []string) {
+	pos, ok := positions(args, 2)
+	if !ok {
+		fmt.Println("Error: usage: move <position> <new position>")
+		return
+	}
 
-	// Dial seedees mp3 port
-	for _, seedee := range seedees {
-		c, _ := net.Dial("udp", net.JoinHostPort(seedee, "6122"))
-		peerToSeedees[seedee] = c
+	song, err := p.Move(pos[0], pos[1])
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
 	}
 
-	if isSourceSeeder {
-		r, err := os.Open("../songs/" + songFile)
-		if err != nil {
-			log.Fatal(err)
-			return
-		}
+	fmt.Println("Moved " + song.Name + " (" + song.ShortHash() + ") to " + strconv.Itoa(pos[1]))
+}
 
-		d := mp3.NewDecoder(r)
+// Vote to skip the current song on every peer
+func handleSkip() {
+	vote, err := p.Skip()
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
 
-		skipped := 0
-		currIndex := 0
-		prebufferedFrames := 0
-		var frame mp3.Frame
+	song := vote.Song.Name + " (" + vote.Song.ShortHash() + ")"
+	if vote.Skipped {
+		fmt.Println("Skipped " + song)
+		return
+	}
 
-		for connectedToTracker {
-			if prebufferedFrames == 300 { // pre-buffered 200 frames before playing
-				// send rpc to start playing
-				go client.Call("ready-to-play", proto.ClientCmdMsg{""}, nil)
-			}
+	fmt.Printf("Voted to skip %s: %d of %d votes\n", song, vote.Votes, vote.Needed)
+}
 
-			if err := d.Decode(&frame, &skipped); err != nil {
-				break
-			}
+// Vote a song up next up or down by its position
+func handleVote(args []string, up bool) {
+	pos, ok := positions(args, 1)
+	if !ok {
+		fmt.Println("Error: usage: upvote <position>, downvote <position>")
+		return
+	}
 
-			reader := frame.Reader()
-			frame_bytes, _ := ioutil.ReadAll(reader)
+	vote, verb := p.Downvote, "Downvoted "
+	if up {
+		vote, verb = p.Upvote, "Upvoted "
+	}
 
-			for _, c := range peerToSeedees {
-				c.Write(frame_bytes)
-				time.Sleep(300 * time.Microsecond)
-			}
+	song, err := vote(pos[0])
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
 
-			// Write frame into local songBuf
-			for j := 0; j < len(frame_bytes); j++ {
-				songBuf[currIndex + j] = frame_bytes[j]
-			}
-		
-			currIndex = currIndex + len(frame_bytes)
-			prebufferedFrames++
-		}
+	fmt.Println(verb + song.Name + " (" + song.ShortHash() + ")")
+}
+
+// Drop every song up next
+func handleClear() {
+	songs, err := p.Clear()
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
 	}
+
+	fmt.Println("Cleared " + strconv.Itoa(len(songs)) + " songs from the queue")
 }
 
-// Returns csv of all song names in the songs folder.
-func getSongNames() ([]string) {
-	var songs []string
-	filepath.Walk("../songs", func (p string, i os.FileInfo, err error) error {
-		if err != nil {
-			log.Println(err)
-			return nil
-		}
+// Parse exactly n queue positions
+func positions(args []string, n int) ([]int, bool) {
+	if len(args) != n {
+		return nil, false
+	}
 
-		s := filepath.Base(p)
-		if strings.Compare(s, "songs") != 0 && strings.Contains(s, ".mp3") {
-			songs = append(songs, s)
+	pos := make([]int, n)
+	for i, arg := range args {
+		var err error
+		if pos[i], err = strconv.Atoi(strings.TrimPrefix(arg, "#")); err != nil {
+			return nil, false
 		}
+	}
 
-		return nil
-	})
+	return pos, true
+}
 
-	return songs
+// Print shell commands
+func handleHelp() {
+	fmt.Print(
+		`commands:
+    join  - connect to a tracker
+    discover - list trackers on the local network
+    leave - disconnect from a tracker
+    list-songs - list all available songs
+    search - search songs, i.e. search artist:vivaldi duration:<5m
+    list-peers - list all peers on the network
+    play - enqueue a song to be played, or play #3 of the last search
+    queue - show the current song and the songs up next
+    remove - remove a song you enqueued from the queue by its position
+    move - move a song you enqueued to where another of yours is, i.e. move 3 1
+    skip - vote to skip the current song
+    upvote - vote a song up next up by its position
+    downvote - vote a song up next down by its position
+    clear - remove every song you enqueued from the queue
+    help - show commands
+    quit - exit the program
+`)
 }
 
-func hasSongLocally(songFile string) bool {
-	for _, song := range getSongNames() {
-		if song == songFile {
-			return true
+// Tell the user about things they didn't ask for
+func watchEvents() {
+	for e := range p.Events() {
+		if e.Type == peer.Disconnected {
+			fmt.Println("\nError: lost the connection to the tracker")
 		}
 	}
-
-	return false
 }
@@ -0,0 +1,84 @@
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Samples an Estimator filters over
+const window = 16
+
+// One round trip of the time-sync rpc, NTP style:
+// t0 client send, t1 tracker receive, t2 tracker send, t3 client receive
+type Sample struct {
+	Offset time.Duration // tracker clock minus ours
+	Delay  time.Duration // round trip, minus time spent on the tracker
+}
+
+func NewSample(t0, t1, t2, t3 time.Time) Sample {
+	return Sample{
+		Offset: (t1.Sub(t0) + t2.Sub(t3)) / 2,
+		Delay:  t3.Sub(t0) - t2.Sub(t1),
+	}
+}
+
+// Estimates the offset between our clock and the tracker's from the last
+// few samples. The sample with the shortest round trip wins, as it has the
+// least room for asymmetric network delay (the NTP clock filter).
+// Safe for concurrent use.
+type Estimator struct {
+	mu      sync.Mutex
+	samples []Sample
+}
+
+func (e *Estimator) Add(s Sample) {
+	if s.Delay < 0 { // clock stepped mid sample
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.samples = append(e.samples, s)
+	if len(e.samples) > window {
+		e.samples = e.samples[len(e.samples)-window:]
+	}
+}
+
+// Best estimate of the tracker's clock minus ours, and the round trip time
+// it was measured over. ok is false until we have a sample.
+func (e *Estimator) Offset() (offset time.Duration, rtt time.Duration, ok bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if len(e.samples) == 0 {
+		return 0, 0, false
+	}
+
+	best := e.samples[0]
+	for _, s := range e.samples[1:] {
+		if s.Delay < best.Delay {
+			best = s
+		}
+	}
+
+	return best.Offset, best.Delay, true
+}
+
+// Convert a time read off the tracker's clock to ours
+func (e *Estimator) ToLocal(t time.Time) time.Time {
+	offset, _, _ := e.Offset()
+	return t.Add(-offset)
+}
+
+// Convert a time read off our clock to the tracker's
+func (e *Estimator) ToTracker(t time.Time) time.Time {
+	offset, _, _ := e.Offset()
+	return t.Add(offset)
+}
+
+func (e *Estimator) Reset() {
+	e.mu.Lock()
+	e.samples = nil
+	e.mu.Unlock()
+}
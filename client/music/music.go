@@ -1,34 +1,277 @@
 package music
 
 import (
-	"log"
-	"github.com/veandco/go-sdl2/sdl"
-	"github.com/veandco/go-sdl2/sdl_mixer"
+	"errors"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+	"github.com/hajimehoshi/go-mp3"
 )
 
-// Load SDL
-func Init() {
-	if err := sdl.Init(sdl.INIT_AUDIO); err != nil {
-		log.Println(err)
-		return
+// Every sink receives signed 16-bit little endian interleaved stereo pcm,
+// which is what the mp3 decoder produces
+const (
+	Channels       = 2
+	BytesPerSample = 2
+	BytesPerFrame  = Channels * BytesPerSample
+)
+
+// Size of each pcm chunk handed to a sink (~23ms at 44.1 kHz)
+const chunkSize = 4096
+
+// Most audio dropped or repeated per chunk when correcting drift, in bytes.
+// 64 sample frames per ~23ms chunk is a ~6% speed change; short enough to
+// go unnoticed in music.
+const maxCorrectionStep = 64 * BytesPerFrame
+
+var ErrStopped = errors.New("music: playback stopped")
+
+// Describes the pcm stream a sink is about to receive
+type Stream struct {
+	Name       string // song file name; used by file backed sinks
+	SampleRate int
+}
+
+// Somewhere to render decoded audio to
+type AudioSink interface {
+	// Prepare the sink for a new song
+	Start(s Stream) error
+
+	// Render a chunk of pcm; may block to keep the sink roughly real-time
+	Write(pcm []byte) (int, error)
+
+	// Finish the current song. If drain is set, block until all audio
+	// written so far has been rendered, else discard it.
+	End(drain bool) error
+
+	// Release the sink for good
+	Close() error
+}
+
+// Implemented by sinks that hold on to audio before it is heard
+type latencySink interface {
+	// Audio written but not yet played
+	Latency() time.Duration
+}
+
+// Returns the sink with the given name. out is the sink's destination
+// where it has one (wav: directory to write songs to).
+func NewSink(kind string, out string) (AudioSink, error) {
+	switch kind {
+	case "sdl":
+		return newSDLSink()
+	case "null":
+		return newNullSink(), nil
+	case "wav":
+		return newWavSink(out)
+	case "pcm":
+		return newPCMSink(os.Stdout), nil
 	}
 
-	if err := mix.Init(mix.INIT_MP3); err != nil {
-		log.Println(err)
-		return
+	return nil, errors.New("music: unknown sink " + kind)
+}
+
+// Decodes mp3 streams into an AudioSink one song at a time
+type Player struct {
+	sink    AudioSink
+	stopped int32
+
+	// Playback position of the current song; all accessed atomically
+	sampleRate int64
+	consumed   int64 // bytes of decoded pcm passed to the sink, counting dropped ones
+	correction int64 // bytes still to drop (> 0) or repeat (< 0) to fix drift
+}
+
+func NewPlayer(sink AudioSink) *Player {
+	return &Player{sink: sink}
+}
+
+// Decode the mp3 stream in r and render it to the sink right away.
+// Blocks until r is exhausted or Stop is called.
+func (p *Player) Play(name string, r io.Reader) error {
+	return p.PlayAt(name, r, time.Time{})
+}
+
+// Like Play, but the first sample reaches the sink at the given wall-clock
+// time. The decoder and sink are warmed up beforehand so that every client
+// told the same time starts together.
+func (p *Player) PlayAt(name string, r io.Reader, at time.Time) error {
+	atomic.StoreInt32(&p.stopped, 0)
+	atomic.StoreInt64(&p.sampleRate, 0)
+	atomic.StoreInt64(&p.consumed, 0)
+	atomic.StoreInt64(&p.correction, 0)
+
+	d, err := mp3.NewDecoder(r)
+	if err != nil {
+		return err
+	}
+
+	if err := p.sink.Start(Stream{name, d.SampleRate()}); err != nil {
+		return err
 	}
 
-	// Default: 22050, mix.DEFAULT_FORMAT, 2, 4096
-	// we want 44.1 kHz/16 bit quality for our songs
-	if err := mix.OpenAudio(44100, mix.DEFAULT_FORMAT, 2, 4096); err != nil {
-		log.Println(err)
-		return
+	buf := make([]byte, chunkSize)
+
+	// Decode the first chunk ahead of time
+	n, err := io.ReadFull(d, buf)
+	if err == io.ErrUnexpectedEOF {
+		err = nil
 	}
+
+	if err != nil && err != io.EOF {
+		p.sink.End(false)
+		return err
+	}
+
+	for wait := time.Until(at); wait > 0; wait = time.Until(at) {
+		if atomic.LoadInt32(&p.stopped) == 1 {
+			p.sink.End(false)
+			return ErrStopped
+		}
+
+		if wait > 10*time.Millisecond {
+			wait = 10 * time.Millisecond
+		}
+
+		time.Sleep(wait)
+	}
+
+	atomic.StoreInt64(&p.sampleRate, int64(d.SampleRate()))
+	atomic.StoreInt64(&p.consumed, int64(n))
+	if _, err := p.sink.Write(buf[:n]); err != nil {
+		p.sink.End(false)
+		return err
+	}
+
+	for {
+		if atomic.LoadInt32(&p.stopped) == 1 {
+			p.sink.End(false)
+			return ErrStopped
+		}
+
+		n, err := d.Read(buf)
+		if n > 0 {
+			pcm := p.correct(buf[:n])
+			atomic.AddInt64(&p.consumed, int64(n))
+			if _, werr := p.sink.Write(pcm); werr != nil {
+				p.sink.End(false)
+				return werr
+			}
+		}
+
+		if err == io.EOF {
+			return p.sink.End(true)
+		}
+
+		if err != nil {
+			p.sink.End(false)
+			return err
+		}
+	}
+}
+
+// How far into the current song playback is, as heard from the sink
+func (p *Player) Position() time.Duration {
+	rate := atomic.LoadInt64(&p.sampleRate)
+	if rate == 0 {
+		return 0
+	}
+
+	pos := pcmDuration(int(atomic.LoadInt64(&p.consumed)), int(rate))
+	if l, ok := p.sink.(latencySink); ok {
+		pos -= l.Latency()
+	}
+
+	if pos < 0 {
+		return 0
+	}
+
+	return pos
+}
+
+// Shift playback by d: skip ahead if d is positive, fall back if negative.
+// Applied a little at a time by dropping or repeating tiny slices of audio.
+// Replaces any correction still in progress.
+func (p *Player) Adjust(d time.Duration) {
+	rate := atomic.LoadInt64(&p.sampleRate)
+	frames := int64(d) * rate / int64(time.Second)
+	atomic.StoreInt64(&p.correction, frames*BytesPerFrame)
+}
+
+// Apply part of the pending drift correction to a chunk of pcm
+func (p *Player) correct(pcm []byte) []byte {
+	c := atomic.LoadInt64(&p.correction)
+	if c == 0 {
+		return pcm
+	}
+
+	k := c
+	if k < 0 {
+		k = -k
+	}
+
+	if k > maxCorrectionStep {
+		k = maxCorrectionStep
+	}
+
+	if k > int64(len(pcm)) {
+		k = int64(len(pcm))
+	}
+
+	k -= k % BytesPerFrame
+	if k == 0 {
+		return pcm
+	}
+
+	if c > 0 { // behind: drop the start of the chunk
+		atomic.AddInt64(&p.correction, -k)
+		return pcm[k:]
+	}
+
+	// ahead: play the end of the chunk twice
+	atomic.AddInt64(&p.correction, k)
+	return append(pcm, pcm[int64(len(pcm))-k:]...)
+}
+
+// Abort the song currently being played, if any
+func (p *Player) Stop() {
+	atomic.StoreInt32(&p.stopped, 1)
+}
+
+func (p *Player) Close() error {
+	p.Stop()
+	return p.sink.Close()
 }
 
-// Teardown SDL
-func Quit() {
-	mix.CloseAudio()
-	mix.Quit()
-	sdl.Quit()
+// Wall-clock length of n bytes of pcm at the given sample rate
+func pcmDuration(n int, sampleRate int) time.Duration {
+	frames := int64(n / BytesPerFrame)
+	return time.Duration(frames * int64(time.Second) / int64(sampleRate))
+}
+
+// Keeps sinks with no audio device of their own running in real-time,
+// so that headless clients finish songs when everyone else does
+type clock struct {
+	start      time.Time
+	played     time.Duration
+	sampleRate int
+}
+
+func (c *clock) reset(sampleRate int) {
+	c.start = time.Time{} // set by the first write
+	c.played = 0
+	c.sampleRate = sampleRate
+}
+
+// Account for n more bytes of pcm and sleep until they are "played"
+func (c *clock) advance(n int) {
+	if c.start.IsZero() {
+		c.start = time.Now()
+	}
+
+	c.played += pcmDuration(n, c.sampleRate)
+	if ahead := c.played - time.Since(c.start); ahead > 0 {
+		time.Sleep(ahead)
+	}
 }
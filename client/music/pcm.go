@@ -0,0 +1,29 @@
+package music
+
+import "io"
+
+// Writes raw pcm (s16le, stereo) to w, i.e. stdout piped into aplay or ffmpeg.
+// The reader sets the pace.
+type pcmSink struct {
+	w io.Writer
+}
+
+func newPCMSink(w io.Writer) *pcmSink {
+	return &pcmSink{w}
+}
+
+func (s *pcmSink) Start(st Stream) error {
+	return nil
+}
+
+func (s *pcmSink) Write(pcm []byte) (int, error) {
+	return s.w.Write(pcm)
+}
+
+func (s *pcmSink) End(drain bool) error {
+	return nil
+}
+
+func (s *pcmSink) Close() error {
+	return nil
+}
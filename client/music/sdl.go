@@ -0,0 +1,94 @@
+//go:build !nosdl
+// +build !nosdl
+
+package music
+
+import (
+	"time"
+	"github.com/veandco/go-sdl2/sdl"
+)
+
+// Cap on the audio we let SDL queue up, in bytes (~0.5s at 44.1 kHz).
+// Keeps stopping a song responsive.
+const maxQueued = 44100 * BytesPerFrame / 2
+
+// Plays audio on the default sound card through SDL's audio queue
+type sdlSink struct {
+	dev  sdl.AudioDeviceID
+	rate int
+}
+
+// Load SDL
+func newSDLSink() (AudioSink, error) {
+	if err := sdl.Init(sdl.INIT_AUDIO); err != nil {
+		return nil, err
+	}
+
+	return &sdlSink{}, nil
+}
+
+func (s *sdlSink) Start(st Stream) error {
+	// we want 16 bit quality at the song's own sample rate
+	want := sdl.AudioSpec{
+		Freq:     int32(st.SampleRate),
+		Format:   sdl.AUDIO_S16LSB,
+		Channels: Channels,
+		Samples:  4096,
+	}
+
+	dev, err := sdl.OpenAudioDevice("", 0, &want, nil, 0)
+	if err != nil {
+		return err
+	}
+
+	s.dev = dev
+	s.rate = st.SampleRate
+	sdl.PauseAudioDevice(s.dev, 0) // start playing
+	return nil
+}
+
+func (s *sdlSink) Write(pcm []byte) (int, error) {
+	for sdl.GetQueuedAudioSize(s.dev) > maxQueued {
+		time.Sleep(5 * time.Millisecond) // block; cpu friendly
+	}
+
+	if err := sdl.QueueAudio(s.dev, pcm); err != nil {
+		return 0, err
+	}
+
+	return len(pcm), nil
+}
+
+// Audio still sitting in SDL's queue
+func (s *sdlSink) Latency() time.Duration {
+	if s.dev == 0 {
+		return 0
+	}
+
+	return pcmDuration(int(sdl.GetQueuedAudioSize(s.dev)), s.rate)
+}
+
+func (s *sdlSink) End(drain bool) error {
+	if s.dev == 0 {
+		return nil
+	}
+
+	if drain {
+		for sdl.GetQueuedAudioSize(s.dev) > 0 {
+			time.Sleep(5 * time.Millisecond)
+		}
+	} else {
+		sdl.ClearQueuedAudio(s.dev)
+	}
+
+	sdl.CloseAudioDevice(s.dev)
+	s.dev = 0
+	return nil
+}
+
+// Teardown SDL
+func (s *sdlSink) Close() error {
+	s.End(false)
+	sdl.Quit()
+	return nil
+}
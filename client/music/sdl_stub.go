@@ -0,0 +1,11 @@
+//go:build nosdl
+// +build nosdl
+
+package music
+
+import "errors"
+
+// Built with -tags nosdl for machines without the SDL2 libraries
+func newSDLSink() (AudioSink, error) {
+	return nil, errors.New("music: built without SDL support, use -sink null, wav or pcm")
+}
@@ -0,0 +1,109 @@
+package music
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const wavHeaderSize = 44
+
+// Records every song played to <dir>/<song>.wav in real-time
+type wavSink struct {
+	dir   string
+	f     *os.File
+	size  uint32 // bytes of pcm written to f
+	clock clock
+}
+
+func newWavSink(dir string) (*wavSink, error) {
+	if dir == "" {
+		dir = "."
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	return &wavSink{dir: dir}, nil
+}
+
+func (s *wavSink) Start(st Stream) error {
+	name := strings.TrimSuffix(filepath.Base(st.Name), filepath.Ext(st.Name))
+	if name == "" || name == "." {
+		name = "song"
+	}
+
+	f, err := os.Create(filepath.Join(s.dir, name+".wav"))
+	if err != nil {
+		return err
+	}
+
+	s.f = f
+	s.size = 0
+	s.clock.reset(st.SampleRate)
+
+	// data sizes are unknown until the song ends; patched in End
+	return s.writeHeader(st.SampleRate)
+}
+
+func (s *wavSink) Write(pcm []byte) (int, error) {
+	n, err := s.f.Write(pcm)
+	s.size += uint32(n)
+	if err != nil {
+		return n, err
+	}
+
+	s.clock.advance(n)
+	return n, nil
+}
+
+func (s *wavSink) End(drain bool) error {
+	if s.f == nil {
+		return nil
+	}
+
+	defer func() { s.f = nil }()
+
+	// fix up the RIFF and data chunk sizes now that we know them
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], 36+s.size)
+	if _, err := s.f.WriteAt(b[:], 4); err != nil {
+		s.f.Close()
+		return err
+	}
+
+	binary.LittleEndian.PutUint32(b[:], s.size)
+	if _, err := s.f.WriteAt(b[:], 40); err != nil {
+		s.f.Close()
+		return err
+	}
+
+	return s.f.Close()
+}
+
+func (s *wavSink) Close() error {
+	return s.End(false)
+}
+
+// Canonical 44 byte PCM wave header
+func (s *wavSink) writeHeader(sampleRate int) error {
+	h := make([]byte, wavHeaderSize)
+	copy(h[0:], "RIFF")
+	binary.LittleEndian.PutUint32(h[4:], 36)
+	copy(h[8:], "WAVE")
+	copy(h[12:], "fmt ")
+	binary.LittleEndian.PutUint32(h[16:], 16) // fmt chunk size
+	binary.LittleEndian.PutUint16(h[20:], 1)  // PCM
+	binary.LittleEndian.PutUint16(h[22:], Channels)
+	binary.LittleEndian.PutUint32(h[24:], uint32(sampleRate))
+	binary.LittleEndian.PutUint32(h[28:], uint32(sampleRate*BytesPerFrame))
+	binary.LittleEndian.PutUint16(h[32:], BytesPerFrame)
+	binary.LittleEndian.PutUint16(h[34:], 8*BytesPerSample)
+	copy(h[36:], "data")
+	binary.LittleEndian.PutUint32(h[40:], 0)
+
+	_, err := s.f.Write(h)
+	return err
+}
@@ -0,0 +1,167 @@
+package stream
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// Largest frame we accept; anything bigger can't have come out of the
+// 2048 byte UDP reads and isn't a real mp3 frame
+const MaxFrameSize = 2048
+
+// Default number of frames a Buffer holds (~100 seconds of 128kbps audio)
+const DefaultCapacity = 4096
+
+var (
+	ErrClosed        = errors.New("stream: buffer closed")
+	ErrEnded         = errors.New("stream: write after end of song")
+	ErrFrameTooLarge = errors.New("stream: frame exceeds max frame size")
+	ErrEmptyFrame    = errors.New("stream: empty frame")
+)
+
+// Bounded ring buffer of mp3 frames for one song.
+// A single writer (the seeding or receiving goroutine) pushes whole frames in
+// while the player reads them back out as a plain byte stream, so songs of any
+// length can be played while they are still arriving. Writers block while the
+// buffer is full, which keeps the source seeder at most a buffer ahead of playback.
+type Buffer struct {
+	mu       sync.Mutex
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
+	progress *sync.Cond // a frame was written, or the song ended or was aborted
+
+	ring  [][]byte
+	head  int // index of the oldest frame
+	count int // frames currently buffered
+
+	partial []byte // unread remainder of the frame at the head
+	written int    // frames written over the song's lifetime
+	ended   bool   // the writer has written the last frame
+	closed  bool   // aborted; readers and writers give up
+}
+
+// Returns a buffer holding at most capacity frames
+func NewBuffer(capacity int) *Buffer {
+	if capacity <= 0 {
+		capacity = DefaultCapacity
+	}
+
+	b := &Buffer{ring: make([][]byte, capacity)}
+	b.notEmpty = sync.NewCond(&b.mu)
+	b.notFull = sync.NewCond(&b.mu)
+	b.progress = sync.NewCond(&b.mu)
+	return b
+}
+
+// Append a copy of frame, blocking while the buffer is full
+func (b *Buffer) Write(frame []byte) error {
+	if len(frame) == 0 {
+		return ErrEmptyFrame
+	}
+
+	if len(frame) > MaxFrameSize {
+		return ErrFrameTooLarge
+	}
+
+	f := make([]byte, len(frame))
+	copy(f, frame)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for b.count == len(b.ring) && !b.closed {
+		b.notFull.Wait()
+	}
+
+	if b.closed {
+		return ErrClosed
+	}
+
+	if b.ended {
+		return ErrEnded
+	}
+
+	b.ring[(b.head+b.count)%len(b.ring)] = f
+	b.count++
+	b.written++
+	b.notEmpty.Signal()
+	b.progress.Broadcast()
+	return nil
+}
+
+// Read buffered audio, blocking until a frame is available.
+// Returns io.EOF once the song has ended and everything was read.
+func (b *Buffer) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for len(b.partial) == 0 && b.count == 0 && !b.ended && !b.closed {
+		b.notEmpty.Wait()
+	}
+
+	if b.closed {
+		return 0, ErrClosed
+	}
+
+	if len(b.partial) == 0 {
+		if b.count == 0 {
+			return 0, io.EOF
+		}
+
+		b.partial = b.ring[b.head]
+		b.ring[b.head] = nil
+		b.head = (b.head + 1) % len(b.ring)
+		b.count--
+		b.notFull.Signal()
+	}
+
+	n := copy(p, b.partial)
+	b.partial = b.partial[n:]
+	return n, nil
+}
+
+// Frames the buffer holds at most
+func (b *Buffer) Cap() int {
+	return len(b.ring)
+}
+
+// Frames written so far
+func (b *Buffer) Written() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.written
+}
+
+// Block until n frames were written or the song ended. Returns false if the
+// song was aborted first.
+func (b *Buffer) WaitWritten(n int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for b.written < n && !b.ended && !b.closed {
+		b.progress.Wait()
+	}
+
+	return !b.closed
+}
+
+// Mark the end of the song; readers get io.EOF after draining the buffer
+func (b *Buffer) CloseWrite() {
+	b.mu.Lock()
+	b.ended = true
+	b.mu.Unlock()
+	b.notEmpty.Broadcast()
+	b.progress.Broadcast()
+}
+
+// Abort the song, waking up any blocked reader or writer
+func (b *Buffer) Close() error {
+	b.mu.Lock()
+	b.closed = true
+	b.mu.Unlock()
+	b.notEmpty.Broadcast()
+	b.notFull.Broadcast()
+	b.progress.Broadcast()
+	return nil
+}
@@ -0,0 +1,222 @@
+package stream
+
+import "encoding/binary"
+
+// XOR parity over groups of consecutive frames.
+//
+// For every group of k frames the seeder sends one parity packet whose
+// payload is
+//
+//	k      uint16  frames in the group
+//	length uint16  xor of the frames' lengths
+//	parity []byte  xor of the frames, zero padded to the longest one
+//
+// Any single frame lost from a group can be rebuilt from the parity and the
+// other k-1 frames. Costs 1/k extra bandwidth.
+
+const fecHeaderSize = 4
+
+// Frames a FECDecoder remembers to rebuild a lost one from
+const fecHistory = 1024
+
+// Builds parity payloads on the seeder side
+type FECEncoder struct {
+	k      int
+	start  uint32 // seq of the first frame in the current group
+	n      int    // frames in the current group so far
+	length uint16
+	parity []byte
+}
+
+// Returns an encoder emitting one parity payload every k frames
+func NewFECEncoder(k int) *FECEncoder {
+	return &FECEncoder{k: k}
+}
+
+// Fold frame seq into the current group. When that completes the group,
+// returns the group's first seq and its parity payload.
+func (e *FECEncoder) Add(seq uint32, frame []byte) (uint32, []byte, bool) {
+	if e.n == 0 {
+		e.start = seq
+		e.length = 0
+		e.parity = e.parity[:0]
+	}
+
+	e.n++
+	e.length ^= uint16(len(frame))
+	e.parity = xorInto(e.parity, frame)
+
+	if e.n < e.k {
+		return 0, nil, false
+	}
+
+	return e.Flush()
+}
+
+// Emit parity for a partial group, i.e. at the end of the song
+func (e *FECEncoder) Flush() (uint32, []byte, bool) {
+	if e.n == 0 {
+		return 0, nil, false
+	}
+
+	payload := make([]byte, fecHeaderSize+len(e.parity))
+	binary.BigEndian.PutUint16(payload[0:], uint16(e.n))
+	binary.BigEndian.PutUint16(payload[2:], e.length)
+	copy(payload[fecHeaderSize:], e.parity)
+
+	e.n = 0
+	return e.start, payload, true
+}
+
+// Parity for a group we couldn't rebuild yet
+type fecGroup struct {
+	k       uint32
+	payload []byte
+}
+
+// Rebuilds single lost frames per group on the seedee side.
+// Not safe for concurrent use.
+type FECDecoder struct {
+	seqs   []uint32
+	frames [][]byte
+	groups map[uint32]fecGroup // by first seq, groups still missing frames
+	newest uint32
+
+	Recovered     int // frames rebuilt from parity
+	Unrecoverable int // frames missing from groups with more than one loss
+}
+
+func NewFECDecoder() *FECDecoder {
+	return &FECDecoder{
+		seqs:   make([]uint32, fecHistory),
+		frames: make([][]byte, fecHistory),
+		groups: make(map[uint32]fecGroup),
+	}
+}
+
+// Remember a frame we received. If it was the last but one frame missing from
+// a group we hold parity for, the final missing frame is rebuilt and returned.
+func (d *FECDecoder) AddFrame(seq uint32, frame []byte) (uint32, []byte, bool) {
+	d.remember(seq, frame)
+
+	for start, g := range d.groups {
+		if seq >= start && seq < start+g.k {
+			return d.tryGroup(start, g)
+		}
+	}
+
+	return 0, nil, false
+}
+
+// Take a parity payload for the group starting at start, returning the
+// group's missing frame if it is the only one missing
+func (d *FECDecoder) AddParity(start uint32, payload []byte) (uint32, []byte, bool) {
+	if len(payload) < fecHeaderSize {
+		return 0, nil, false
+	}
+
+	g := fecGroup{uint32(binary.BigEndian.Uint16(payload)), payload}
+	if g.k == 0 {
+		return 0, nil, false
+	}
+
+	if start+g.k-1 > d.newest {
+		d.newest = start + g.k - 1
+	}
+
+	d.expire()
+	return d.tryGroup(start, g)
+}
+
+// Count the frames of every group still incomplete as unrecoverable
+func (d *FECDecoder) Flush() {
+	for start, g := range d.groups {
+		d.Unrecoverable += len(d.missing(start, g))
+		delete(d.groups, start)
+	}
+}
+
+func (d *FECDecoder) tryGroup(start uint32, g fecGroup) (uint32, []byte, bool) {
+	missing := d.missing(start, g)
+	switch len(missing) {
+	case 0:
+		delete(d.groups, start)
+		return 0, nil, false
+	case 1:
+		delete(d.groups, start)
+	default:
+		d.groups[start] = g // wait for retransmissions
+		return 0, nil, false
+	}
+
+	length := binary.BigEndian.Uint16(g.payload[2:])
+	frame := append([]byte(nil), g.payload[fecHeaderSize:]...)
+	for seq := start; seq < start+g.k; seq++ {
+		if f, ok := d.get(seq); ok {
+			length ^= uint16(len(f))
+			xorInto(frame, f)
+		}
+	}
+
+	if int(length) > len(frame) || length == 0 {
+		return 0, nil, false // parity doesn't add up; corrupt group
+	}
+
+	frame = frame[:length]
+	d.remember(missing[0], frame)
+	d.Recovered++
+	return missing[0], frame, true
+}
+
+func (d *FECDecoder) missing(start uint32, g fecGroup) []uint32 {
+	var missing []uint32
+	for seq := start; seq < start+g.k; seq++ {
+		if _, ok := d.get(seq); !ok {
+			missing = append(missing, seq)
+		}
+	}
+
+	return missing
+}
+
+// Drop groups whose frames have fallen out of our history
+func (d *FECDecoder) expire() {
+	for start, g := range d.groups {
+		if d.newest >= fecHistory && start < d.newest-fecHistory+1 {
+			d.Unrecoverable += len(d.missing(start, g))
+			delete(d.groups, start)
+		}
+	}
+}
+
+func (d *FECDecoder) remember(seq uint32, frame []byte) {
+	if seq > d.newest {
+		d.newest = seq
+	}
+
+	i := int(seq % fecHistory)
+	d.seqs[i] = seq
+	d.frames[i] = append(d.frames[i][:0], frame...)
+}
+
+func (d *FECDecoder) get(seq uint32) ([]byte, bool) {
+	i := int(seq % fecHistory)
+	if d.frames[i] == nil || d.seqs[i] != seq {
+		return nil, false
+	}
+
+	return d.frames[i], true
+}
+
+// dst ^= src, growing dst to fit src
+func xorInto(dst []byte, src []byte) []byte {
+	for len(dst) < len(src) {
+		dst = append(dst, 0)
+	}
+
+	for i := range src {
+		dst[i] ^= src[i]
+	}
+
+	return dst
+}
@@ -0,0 +1,135 @@
+package stream
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+// Frames of different lengths, so rebuilding one has to get its length right
+func testFrames(n int) [][]byte {
+	frames := make([][]byte, n)
+	for i := range frames {
+		frames[i] = bytes.Repeat([]byte{byte(i*37 + 1), byte(i)}, 50+i*7)
+	}
+
+	return frames
+}
+
+// Encode frames starting at seq start, returning every parity packet
+func testParity(t *testing.T, k int, start uint32, frames [][]byte) map[uint32][]byte {
+	t.Helper()
+
+	e := NewFECEncoder(k)
+	parity := make(map[uint32][]byte)
+	for i, frame := range frames {
+		if first, p, ok := e.Add(start+uint32(i), frame); ok {
+			parity[first] = p
+		}
+	}
+	if first, p, ok := e.Flush(); ok {
+		parity[first] = p
+	}
+
+	return parity
+}
+
+func TestFECRebuildsAnyOneLostFrame(t *testing.T) {
+	const k = 5
+	const start = 1000
+	frames := testFrames(k)
+
+	for _, parityFirst := range []bool{false, true} {
+		for lost := 0; lost < k; lost++ {
+			t.Run(fmt.Sprintf("lost %d, parity first %v", lost, parityFirst), func(t *testing.T) {
+				parity := testParity(t, k, start, frames)
+				if len(parity) != 1 || parity[start] == nil {
+					t.Fatalf("got parity for groups %v, want one for %d", parity, start)
+				}
+
+				d := NewFECDecoder()
+				var seq uint32
+				var frame []byte
+				rebuilt := false
+				take := func(s uint32, f []byte, ok bool) {
+					if ok {
+						if rebuilt {
+							t.Fatalf("rebuilt %d after already rebuilding %d", s, seq)
+						}
+						seq, frame, rebuilt = s, f, true
+					}
+				}
+
+				if parityFirst {
+					take(d.AddParity(start, parity[start]))
+				}
+				for i, f := range frames {
+					if i != lost {
+						take(d.AddFrame(start+uint32(i), f))
+					}
+				}
+				if !parityFirst {
+					take(d.AddParity(start, parity[start]))
+				}
+				d.Flush()
+
+				if !rebuilt || seq != start+uint32(lost) || !bytes.Equal(frame, frames[lost]) {
+					t.Fatalf("rebuilt %v seq %d (%d bytes), want seq %d (%d bytes)", rebuilt, seq, len(frame), start+lost, len(frames[lost]))
+				}
+				if d.Recovered != 1 || d.Unrecoverable != 0 {
+					t.Fatalf("recovered %d, unrecoverable %d; want 1 and 0", d.Recovered, d.Unrecoverable)
+				}
+			})
+		}
+	}
+}
+
+func TestFECCountsWhatItCantRebuild(t *testing.T) {
+	tests := []struct {
+		name          string
+		k             int
+		frames        int
+		lost          []int
+		recovered     int
+		unrecoverable int
+	}{
+		{"nothing lost", 4, 8, nil, 0, 0},
+		{"one per group", 4, 8, []int{1, 6}, 2, 0},
+		{"two in a group", 4, 8, []int{0, 3}, 0, 2},
+		{"two in one group, one in the other", 4, 8, []int{2, 3, 5}, 1, 2},
+		{"one in a partial group", 4, 6, []int{5}, 1, 0},
+		{"whole partial group", 4, 6, []int{4, 5}, 0, 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			frames := testFrames(test.frames)
+			parity := testParity(t, test.k, 0, frames)
+
+			lost := make(map[int]bool)
+			for _, i := range test.lost {
+				lost[i] = true
+			}
+
+			d := NewFECDecoder()
+			for i, f := range frames {
+				if !lost[i] {
+					d.AddFrame(uint32(i), f)
+				}
+
+				// Parity follows the last frame of its group
+				if p, ok := parity[uint32(i+1-test.k)]; ok && (i+1)%test.k == 0 {
+					d.AddParity(uint32(i+1-test.k), p)
+				}
+			}
+			if p, ok := parity[uint32(test.frames/test.k*test.k)]; ok {
+				d.AddParity(uint32(test.frames/test.k*test.k), p)
+			}
+			d.Flush()
+
+			if d.Recovered != test.recovered || d.Unrecoverable != test.unrecoverable {
+				t.Fatalf("recovered %d, unrecoverable %d; want %d and %d", d.Recovered, d.Unrecoverable, test.recovered, test.unrecoverable)
+			}
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package stream
+
+import (
+	"sync"
+	"time"
+)
+
+// Default pacing: send at one and a half times real-time, letting up to
+// ten seconds of audio (enough to prebuffer) go out back to back
+const (
+	DefaultPace  = 1.5
+	DefaultBurst = 10 * time.Second
+)
+
+// Token bucket that meters audio out to one seedee.
+// Tokens are seconds of audio; they refill at rate seconds per wall-clock
+// second and cap out at burst. A rate of 0 or less disables pacing.
+type Pacer struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  time.Duration
+	tokens time.Duration
+	last   time.Time
+}
+
+// Returns a pacer with a full bucket so a song starts with a burst
+func NewPacer(rate float64, burst time.Duration) *Pacer {
+	return &Pacer{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// Block until d worth of audio may be sent
+func (p *Pacer) Wait(d time.Duration) {
+	if p.rate <= 0 || d <= 0 {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.refill()
+	if p.tokens < d {
+		time.Sleep(time.Duration(float64(d-p.tokens) / p.rate))
+		p.refill()
+	}
+
+	p.tokens -= d
+}
+
+func (p *Pacer) refill() {
+	now := time.Now()
+	p.tokens += time.Duration(float64(now.Sub(p.last)) * p.rate)
+	if p.tokens > p.burst {
+		p.tokens = p.burst
+	}
+
+	p.last = now
+}
@@ -0,0 +1,139 @@
+package stream
+
+// Default number of out of order frames held back waiting for a gap to fill
+const DefaultWindow = 256
+
+// Puts sequence numbered frames back in order before they reach a Buffer.
+// Duplicates and frames from before the current position are dropped. If a
+// gap stays open for more than window frames, the missing frames are given up
+// on so playback can carry on. Not safe for concurrent use.
+type Reassembler struct {
+	buf     *Buffer
+	next    uint32            // seq of the next frame the buffer wants
+	pending map[uint32][]byte // frames that arrived ahead of next
+	window  int
+	total   uint32 // frames in the song, 0 while unknown
+
+	Duplicates int // frames we already had
+	Skipped    int // frames given up on
+}
+
+func NewReassembler(buf *Buffer, window int) *Reassembler {
+	if window <= 0 {
+		window = DefaultWindow
+	}
+
+	return &Reassembler{
+		buf:     buf,
+		pending: make(map[uint32][]byte),
+		window:  window,
+	}
+}
+
+// Record how many frames the song has so we know when it is complete
+func (r *Reassembler) SetTotal(total uint32) {
+	if total != 0 {
+		r.total = total
+	}
+}
+
+// Accept frame seq, writing out every frame that is now in order.
+// Returns the Buffer's error if it can't take any more frames.
+func (r *Reassembler) Add(seq uint32, frame []byte) error {
+	if seq < r.next || r.pending[seq] != nil {
+		r.Duplicates++
+		return nil
+	}
+
+	f := make([]byte, len(frame))
+	copy(f, frame)
+	r.pending[seq] = f
+
+	if len(r.pending) > r.window {
+		r.skipGap()
+	}
+
+	return r.drain()
+}
+
+// Give up on every missing frame and write out whatever is pending.
+// Called when the stream ends without the song being complete.
+func (r *Reassembler) Flush() error {
+	for len(r.pending) > 0 {
+		r.skipGap()
+		if err := r.drain(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Sequence numbers of the frames we are missing, at most max of them.
+// Only gaps below the newest frame seen are reported unless tail is set, in
+// which case everything up to the end of the song counts as missing.
+func (r *Reassembler) Missing(max int, tail bool) []uint32 {
+	end := r.next
+	for seq := range r.pending {
+		if seq+1 > end {
+			end = seq + 1
+		}
+	}
+
+	if tail && r.total > end {
+		end = r.total
+	}
+
+	var missing []uint32
+	for seq := r.next; seq < end && len(missing) < max; seq++ {
+		if _, ok := r.pending[seq]; !ok {
+			missing = append(missing, seq)
+		}
+	}
+
+	return missing
+}
+
+// Next sequence number we are waiting on
+func (r *Reassembler) Next() uint32 {
+	return r.next
+}
+
+// True once every frame of the song has been written out
+func (r *Reassembler) Done() bool {
+	return r.total != 0 && r.next >= r.total
+}
+
+// Write out frames from next onwards until the next gap
+func (r *Reassembler) drain() error {
+	for {
+		f, ok := r.pending[r.next]
+		if !ok {
+			return nil
+		}
+
+		delete(r.pending, r.next)
+		r.next++
+
+		if err := r.buf.Write(f); err != nil {
+			return err
+		}
+	}
+}
+
+// Move next past the gap to the earliest pending frame
+func (r *Reassembler) skipGap() {
+	first := true
+	var min uint32
+	for seq := range r.pending {
+		if first || seq < min {
+			min = seq
+			first = false
+		}
+	}
+
+	if !first && min > r.next {
+		r.Skipped += int(min - r.next)
+		r.next = min
+	}
+}
@@ -0,0 +1,75 @@
+package stream
+
+import (
+	"sort"
+	"sync"
+)
+
+// Default number of recently sent packets kept for retransmission
+const DefaultSendWindow = 1024
+
+// Remembers the last few packets a seeder sent, by sequence number, so that
+// frames NACKed by a seedee can be resent. Safe for concurrent use.
+type SendWindow struct {
+	mu      sync.Mutex
+	seqs    []uint32
+	packets [][]byte
+}
+
+func NewSendWindow(size int) *SendWindow {
+	if size <= 0 {
+		size = DefaultSendWindow
+	}
+
+	return &SendWindow{
+		seqs:    make([]uint32, size),
+		packets: make([][]byte, size),
+	}
+}
+
+// Keep a copy of the packet carrying frame seq, evicting the oldest one
+func (w *SendWindow) Put(seq uint32, packet []byte) {
+	p := make([]byte, len(packet))
+	copy(p, packet)
+
+	w.mu.Lock()
+	i := int(seq % uint32(len(w.seqs)))
+	w.seqs[i] = seq
+	w.packets[i] = p
+	w.mu.Unlock()
+}
+
+// Packet carrying frame seq, if it is still in the window
+func (w *SendWindow) Get(seq uint32) ([]byte, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	i := int(seq % uint32(len(w.seqs)))
+	if w.packets[i] == nil || w.seqs[i] != seq {
+		return nil, false
+	}
+
+	return w.packets[i], true
+}
+
+// Every packet in the window, oldest frame first
+func (w *SendWindow) Packets() [][]byte {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	idx := make([]int, 0, len(w.seqs))
+	for i, p := range w.packets {
+		if p != nil {
+			idx = append(idx, i)
+		}
+	}
+
+	sort.Slice(idx, func(a, b int) bool { return w.seqs[idx[a]] < w.seqs[idx[b]] })
+
+	packets := make([][]byte, len(idx))
+	for j, i := range idx {
+		packets[j] = w.packets[i]
+	}
+
+	return packets
+}
@@ -0,0 +1,252 @@
+// Package tags reads the title, artist and album out of the ID3 tags of
+// an mp3 file.
+package tags
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"unicode/utf16"
+)
+
+var ErrBadTag = errors.New("tags: malformed ID3v2 tag")
+
+type Tags struct {
+	Title  string
+	Artist string
+	Album  string
+}
+
+// Tag sizes
+const (
+	id3v2HeaderSize = 10
+	id3v1Size       = 128
+)
+
+// ID3v2 header flags
+const (
+	flagUnsync   = 0x80
+	flagExtended = 0x40
+	flagFooter   = 0x10
+)
+
+// Read the tags of the mp3 file in r. ID3v2 (2.2, 2.3 and 2.4) wins over
+// ID3v1 field by field. A file without tags has empty Tags, not an error.
+func Read(r io.ReadSeeker) (Tags, error) {
+	var t Tags
+
+	v2, err := readV2(r)
+	if err != nil {
+		return t, err
+	}
+
+	v1, err := readV1(r)
+	if err != nil {
+		return t, err
+	}
+
+	t.Title = first(v2.Title, v1.Title)
+	t.Artist = first(v2.Artist, v1.Artist)
+	t.Album = first(v2.Album, v1.Album)
+	return t, nil
+}
+
+// Seek past the ID3v2 tag at the start of r, if there is one, so a frame
+// decoder can't mistake bytes in the tag for frames
+func SkipID3v2(r io.ReadSeeker) error {
+	size, _, _, err := v2Header(r)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.Seek(size, io.SeekStart)
+	return err
+}
+
+// Total size of the ID3v2 tag at the start of r (0 if none), its major
+// version and flags. Leaves r just past the header, or at the start if
+// there's no tag.
+func v2Header(r io.ReadSeeker) (int64, byte, byte, error) {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return 0, 0, 0, err
+	}
+
+	var h [id3v2HeaderSize]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil || string(h[:3]) != "ID3" {
+		_, err := r.Seek(0, io.SeekStart)
+		return 0, 0, 0, err
+	}
+
+	size := id3v2HeaderSize + syncsafe(h[6:10])
+	if h[5]&flagFooter != 0 {
+		size += id3v2HeaderSize
+	}
+
+	return size, h[3], h[5], nil
+}
+
+func readV2(r io.ReadSeeker) (Tags, error) {
+	var t Tags
+
+	size, version, flags, err := v2Header(r)
+	if err != nil || size == 0 {
+		return t, err
+	}
+
+	if flags&flagFooter != 0 {
+		size -= id3v2HeaderSize
+	}
+
+	body := make([]byte, size-id3v2HeaderSize)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return t, ErrBadTag
+	}
+
+	// Up to 2.3 the whole tag is unsynchronised: a 0 stuffed after every 0xFF
+	if flags&flagUnsync != 0 && version <= 3 {
+		body = bytes.ReplaceAll(body, []byte{0xFF, 0}, []byte{0xFF})
+	}
+
+	if flags&flagExtended != 0 && version >= 3 {
+		if len(body) < 4 {
+			return t, ErrBadTag
+		}
+
+		n := syncsafe(body[:4]) // 2.4 counts the size bytes
+		if version == 3 {
+			n = int64(binary.BigEndian.Uint32(body[:4])) + 4
+		}
+
+		if n > int64(len(body)) {
+			return t, ErrBadTag
+		}
+		body = body[n:]
+	}
+
+	// Frame ids and header sizes went from 3 to 4 bytes in 2.3
+	idLen, headerLen := 4, 10
+	if version == 2 {
+		idLen, headerLen = 3, 6
+	}
+
+	for len(body) >= headerLen && body[0] != 0 { // the rest is padding
+		id := string(body[:idLen])
+
+		var n int64
+		switch version {
+		case 2:
+			n = int64(body[3])<<16 | int64(body[4])<<8 | int64(body[5])
+		case 3:
+			n = int64(binary.BigEndian.Uint32(body[4:8]))
+		default: // 2.4 frame sizes are syncsafe
+			n = syncsafe(body[4:8])
+		}
+
+		if n > int64(len(body)-headerLen) {
+			return t, ErrBadTag
+		}
+
+		value := body[headerLen : headerLen+int(n)]
+		switch id {
+		case "TIT2", "TT2":
+			t.Title = text(value)
+		case "TPE1", "TP1":
+			t.Artist = text(value)
+		case "TALB", "TAL":
+			t.Album = text(value)
+		}
+
+		body = body[headerLen+int(n):]
+	}
+
+	return t, nil
+}
+
+func readV1(r io.ReadSeeker) (Tags, error) {
+	var t Tags
+
+	end, err := r.Seek(0, io.SeekEnd)
+	if err != nil || end < id3v1Size {
+		return t, err
+	}
+
+	var b [id3v1Size]byte
+	if _, err := r.Seek(end-id3v1Size, io.SeekStart); err != nil {
+		return t, err
+	}
+
+	if _, err := io.ReadFull(r, b[:]); err != nil || string(b[:3]) != "TAG" {
+		return t, nil
+	}
+
+	t.Title = latin1(b[3:33])
+	t.Artist = latin1(b[33:63])
+	t.Album = latin1(b[63:93])
+	return t, nil
+}
+
+// Decode a text frame: an encoding byte followed by the text
+func text(b []byte) string {
+	if len(b) == 0 {
+		return ""
+	}
+
+	s := b[1:]
+	switch b[0] {
+	case 0: // ISO-8859-1
+		return latin1(s)
+	case 1: // UTF-16 with a byte order mark
+		if len(s) >= 2 && s[0] == 0xFF && s[1] == 0xFE {
+			return utf16String(s[2:], binary.LittleEndian)
+		}
+		if len(s) >= 2 && s[0] == 0xFE && s[1] == 0xFF {
+			s = s[2:]
+		}
+		return utf16String(s, binary.BigEndian)
+	case 2: // UTF-16BE
+		return utf16String(s, binary.BigEndian)
+	default: // UTF-8
+		return clean(string(s))
+	}
+}
+
+func latin1(b []byte) string {
+	r := make([]rune, len(b))
+	for i, c := range b {
+		r[i] = rune(c)
+	}
+
+	return clean(string(r))
+}
+
+func utf16String(b []byte, order binary.ByteOrder) string {
+	u := make([]uint16, len(b)/2)
+	for i := range u {
+		u[i] = order.Uint16(b[2*i:])
+	}
+
+	return clean(string(utf16.Decode(u)))
+}
+
+// Drop everything after the first NUL, and surrounding space
+func clean(s string) string {
+	if i := strings.IndexRune(s, 0); i >= 0 {
+		s = s[:i]
+	}
+
+	return strings.TrimSpace(s)
+}
+
+func syncsafe(b []byte) int64 {
+	return int64(b[0]&0x7F)<<21 | int64(b[1]&0x7F)<<14 | int64(b[2]&0x7F)<<7 | int64(b[3]&0x7F)
+}
+
+func first(a, b string) string {
+	if a != "" {
+		return a
+	}
+
+	return b
+}
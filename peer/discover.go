@@ -0,0 +1,101 @@
+package peer
+
+import (
+	"net"
+	"mob/proto"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// How long Discover waits for trackers to answer by default
+const DefaultDiscoverTimeout = time.Second
+
+// A tracker that answered our discovery probe
+type TrackerInfo struct {
+	Name  string
+	Addr  string // ip:port to Join
+	Peers int
+}
+
+// Find the trackers on our local networks by broadcasting a probe and
+// collecting the answers that come back within timeout. Doesn't need us
+// to be joined.
+func (p *Peer) Discover(timeout time.Duration) ([]TrackerInfo, error) {
+	if timeout <= 0 {
+		timeout = DefaultDiscoverTimeout
+	}
+
+	pc, err := p.cfg.Network.ListenPacket("udp", ":0")
+	if err != nil {
+		return nil, err
+	}
+
+	defer pc.Close()
+
+	port := strconv.Itoa(proto.DiscoveryPort)
+	for _, ip := range proto.BroadcastAddrs(p.cfg.Interface) {
+		if addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(ip, port)); err == nil {
+			pc.WriteTo([]byte(proto.DiscoveryProbe), addr)
+		}
+	}
+
+	// A tracker may hear us on several addresses; it answers each
+	found := make(map[string]TrackerInfo)
+	deadline := time.Now().Add(timeout)
+	buf := make([]byte, 512)
+	for {
+		pc.SetReadDeadline(deadline)
+		n, from, err := pc.ReadFrom(buf)
+		if e, ok := err.(net.Error); ok && e.Timeout() {
+			break
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		a, err := proto.DecodeTrackerAnnouncement(buf[:n])
+		if err != nil || a.Port == 0 {
+			continue
+		}
+
+		ip, _, _ := net.SplitHostPort(from.String())
+		addr := net.JoinHostPort(ip, strconv.Itoa(a.Port))
+		found[addr] = TrackerInfo{a.Name, addr, a.Peers}
+	}
+
+	// A tracker on our own machine answers on loopback too; list it once,
+	// at an address the other peers can reach
+	lan := make(map[string]bool)
+	for addr, t := range found {
+		if !isLoopback(addr) {
+			_, port, _ := net.SplitHostPort(addr)
+			lan[t.Name+":"+port] = true
+		}
+	}
+
+	trackers := make([]TrackerInfo, 0, len(found))
+	for addr, t := range found {
+		_, port, _ := net.SplitHostPort(addr)
+		if isLoopback(addr) && lan[t.Name+":"+port] {
+			continue
+		}
+		trackers = append(trackers, t)
+	}
+
+	sort.Slice(trackers, func(i, j int) bool {
+		if trackers[i].Name != trackers[j].Name {
+			return trackers[i].Name < trackers[j].Name
+		}
+		return trackers[i].Addr < trackers[j].Addr
+	})
+
+	return trackers, nil
+}
+
+func isLoopback(addr string) bool {
+	host, _, _ := net.SplitHostPort(addr)
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
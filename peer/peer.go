@@ -0,0 +1,348 @@
+// Package peer is a mob client: it joins a tracker, seeds and relays songs
+// to the other peers and plays them in step with everyone else.
+package peer
+
+import (
+	"errors"
+	"crypto/rand"
+	"encoding/hex"
+	"mob/proto"
+	"mob/client/music"
+	"mob/client/stream"
+	"net"
+	"sync"
+	"time"
+)
+
+var ErrNotJoined = errors.New("peer: not connected to a tracker")
+
+// The sockets a peer talks through; swapped out to run peers over
+// something other than the real network
+type Network interface {
+	Dial(network, address string) (net.Conn, error)
+	ListenPacket(network, address string) (net.PacketConn, error)
+}
+
+type systemNetwork struct{}
+
+func (systemNetwork) Dial(network, address string) (net.Conn, error) {
+	return net.Dial(network, address)
+}
+
+func (systemNetwork) ListenPacket(network, address string) (net.PacketConn, error) {
+	return net.ListenPacket(network, address)
+}
+
+// The operating system's network
+var SystemNetwork Network = systemNetwork{}
+
+type Config struct {
+	Id           string        // who we are to the tracker, the same across rejoins; random if empty
+	Ip           string        // our address on the network; discovered if empty
+	Interface    string        // discover Ip on this network interface only
+	SongsDir     string        // where our own songs are
+	ScanInterval time.Duration // how often to look for songs added to or removed from SongsDir; 0 never
+	Player       *music.Player // plays songs; discards audio if nil
+	Network      Network       // SystemNetwork if nil
+	MaxSeedees   int           // seedees we stream to at most
+	LeaveDelay   time.Duration // time given to in-flight packets before leaving
+
+	HandshakePort int // udp port for handshake packets; 0 picks a free one
+	MediaPort     int // udp port for mp3 frames; 0 picks a free one
+
+	BufferFrames int           // max mp3 frames buffered ahead of playback
+	Pace         float64       // stream to seedees at this multiple of real-time; 0 is unpaced
+	Burst        time.Duration // audio that may be streamed to a seedee back to back
+	Drift        time.Duration // correct playback drifting further than this from the other peers
+	Nacks        bool          // ask our seeder to resend lost frames
+	FEC          int           // send a parity packet every this many frames; 0 is off
+}
+
+// The settings the client starts with
+func DefaultConfig() Config {
+	return Config{
+		SongsDir:     "../songs",
+		ScanInterval: 2 * time.Second,
+		MaxSeedees:   1,
+		LeaveDelay:   3 * time.Second,
+		BufferFrames: stream.DefaultCapacity,
+		Pace:         stream.DefaultPace,
+		Burst:        stream.DefaultBurst,
+		Drift:        20 * time.Millisecond,
+		Nacks:        true,
+	}
+}
+
+type EventType int
+
+const (
+	SongChanged  EventType = iota // Song moved to State
+	Disconnected                  // the tracker hung up on us
+)
+
+type Event struct {
+	Type  EventType
+	Song  proto.Song
+	State SongState
+}
+
+// Events are dropped rather than holding up the peer when nobody reads them
+const eventQueueLen = 64
+
+// A mob peer. It can be in one tracker's network at a time.
+type Peer struct {
+	cfg    Config
+	player *music.Player
+	events chan Event
+
+	mu sync.Mutex // guards s
+	s  *session   // the tracker we joined, nil if none
+
+	songsMu   sync.Mutex          // guards songFiles and songPaths
+	songFiles map[string]songFile // our hashed songs, by path
+	songPaths map[string]string   // where each of them is, by hash, as of the last scan
+}
+
+func New(cfg Config) *Peer {
+	if cfg.Network == nil {
+		cfg.Network = SystemNetwork
+	}
+
+	if cfg.MaxSeedees < 1 {
+		cfg.MaxSeedees = 1
+	}
+
+	if cfg.Id == "" {
+		cfg.Id = randomId()
+	}
+
+	player := cfg.Player
+	if player == nil {
+		sink, _ := music.NewSink("null", "")
+		player = music.NewPlayer(sink)
+	}
+
+	return &Peer{
+		cfg:       cfg,
+		player:    player,
+		events:    make(chan Event, eventQueueLen),
+		songFiles: make(map[string]songFile),
+		songPaths: make(map[string]string),
+	}
+}
+
+// Who we are to the tracker; the songs we enqueue stay ours across rejoins
+func (p *Peer) Id() string {
+	return p.cfg.Id
+}
+
+// Join the tracker at addr, leaving the one we're in first
+func (p *Peer) Join(addr string) error {
+	p.Leave()
+
+	if p.cfg.Ip == "" {
+		ip, err := proto.GetLocalIp(p.cfg.Interface)
+		if err != nil {
+			return err
+		}
+		p.cfg.Ip = ip
+	}
+
+	s, err := newSession(p, addr)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	p.s = s
+	p.mu.Unlock()
+	return nil
+}
+
+// Leave the tracker we joined, if any
+func (p *Peer) Leave() {
+	p.mu.Lock()
+	s := p.s
+	p.s = nil
+	p.mu.Unlock()
+
+	if s != nil {
+		s.leave()
+	}
+}
+
+// Are we in a tracker's network
+func (p *Peer) Joined() bool {
+	return p.session() != nil
+}
+
+// Songs available to be played
+func (p *Peer) ListSongs() ([]proto.Song, error) {
+	s := p.session()
+	if s == nil {
+		return nil, ErrNotJoined
+	}
+
+	var res proto.SongList
+	err := s.client.Call("list-songs", proto.ClientCmdMsg{""}, &res)
+	return res.Songs, err
+}
+
+// Songs matching a search query, best matches first. See the tracker's
+// search rpc for the query syntax.
+func (p *Peer) Search(query string) ([]proto.Song, error) {
+	s := p.session()
+	if s == nil {
+		return nil, ErrNotJoined
+	}
+
+	var res proto.SongList
+	err := s.client.Call("search", proto.ClientCmdMsg{query}, &res)
+	return res.Songs, err
+}
+
+// Peers connected to the tracker, with their clock offsets
+func (p *Peer) ListPeers() ([]proto.PeerInfo, error) {
+	s := p.session()
+	if s == nil {
+		return nil, ErrNotJoined
+	}
+
+	var res proto.PeerList
+	err := s.client.Call("list-peers", proto.ClientCmdMsg{""}, &res)
+	return res.Peers, err
+}
+
+// Add a song to the tracker's queue, by its hash (or a prefix of it) or
+// its name. Returns the song that was queued.
+func (p *Peer) Enqueue(song string) (proto.Song, error) {
+	s := p.session()
+	if s == nil {
+		return proto.Song{}, ErrNotJoined
+	}
+
+	var res proto.Song
+	err := s.client.Call("play", proto.ClientCmdMsg{song}, &res)
+	return res, err
+}
+
+// The tracker's current song (zero while idle) and the songs up next, with
+// their votes and who enqueued them
+func (p *Peer) Queue() (proto.QueueList, error) {
+	s := p.session()
+	if s == nil {
+		return proto.QueueList{}, ErrNotJoined
+	}
+
+	var res proto.QueueList
+	err := s.client.Call("queue", proto.ClientCmdMsg{""}, &res)
+	return res, err
+}
+
+// Drop the song at pos among the songs up next, counting from 1, if we
+// enqueued it. Returns the song that was dropped.
+func (p *Peer) Remove(pos int) (proto.Song, error) {
+	return p.queueCmd("remove", proto.QueueCmdMsg{pos, 0})
+}
+
+// Move the song at pos among the songs up next to position to, where
+// another of the songs we enqueued is
+func (p *Peer) Move(pos int, to int) (proto.Song, error) {
+	return p.queueCmd("move", proto.QueueCmdMsg{pos, to})
+}
+
+// Drop every song up next we enqueued, returning them; the current song
+// plays on
+func (p *Peer) Clear() ([]proto.Song, error) {
+	s := p.session()
+	if s == nil {
+		return nil, ErrNotJoined
+	}
+
+	var res proto.SongList
+	err := s.client.Call("clear", proto.ClientCmdMsg{""}, &res)
+	return res.Songs, err
+}
+
+// Vote to skip the current song. Once enough peers voted the tracker
+// abandons it on every peer and moves on to the next one.
+func (p *Peer) Skip() (proto.SkipVote, error) {
+	s := p.session()
+	if s == nil {
+		return proto.SkipVote{}, ErrNotJoined
+	}
+
+	var res proto.SkipVote
+	err := s.client.Call("skip", proto.ClientCmdMsg{""}, &res)
+	return res, err
+}
+
+// Vote the song at pos among the songs up next up; the queue is ordered by
+// votes. Returns the song voted on.
+func (p *Peer) Upvote(pos int) (proto.Song, error) {
+	return p.vote(pos, 1)
+}
+
+// Vote the song at pos among the songs up next down
+func (p *Peer) Downvote(pos int) (proto.Song, error) {
+	return p.vote(pos, -1)
+}
+
+func (p *Peer) vote(pos int, vote int) (proto.Song, error) {
+	s := p.session()
+	if s == nil {
+		return proto.Song{}, ErrNotJoined
+	}
+
+	var res proto.Song
+	err := s.client.Call("vote", proto.VoteMsg{pos, vote}, &res)
+	return res, err
+}
+
+func (p *Peer) queueCmd(method string, args proto.QueueCmdMsg) (proto.Song, error) {
+	s := p.session()
+	if s == nil {
+		return proto.Song{}, ErrNotJoined
+	}
+
+	var res proto.Song
+	err := s.client.Call(method, args, &res)
+	return res, err
+}
+
+// Where we are with the current song, Idle if not joined
+func (p *Peer) State() (SongState, proto.Song) {
+	s := p.session()
+	if s == nil {
+		return Idle, proto.Song{}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state, s.song
+}
+
+// What happens to the peer as it goes along
+func (p *Peer) Events() <-chan Event {
+	return p.events
+}
+
+func (p *Peer) session() *session {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.s
+}
+
+func (p *Peer) emit(e Event) {
+	select {
+	case p.events <- e:
+	default:
+	}
+}
+
+// A name for a peer nobody named, unlikely to be anyone else's
+func randomId() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,507 @@
+package peer
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"mob/proto"
+	"mob/client/stream"
+	"mob/client/music"
+	"mob/client/clock"
+	"github.com/cenkalti/rpc2"
+	"sync"
+	"time"
+)
+
+// Clock sync: a burst of samples every syncInterval
+const (
+	syncInterval = 10 * time.Second
+	syncSamples  = 8
+	syncSpacing  = 100 * time.Millisecond
+)
+
+// How often we report our playback position, for drift correction
+const positionInterval = time.Second
+
+// Where we are with the current song
+type SongState int
+
+const (
+	Idle        SongState = iota // no song
+	Handshaking                  // seeding; looking for seedees to stream to
+	Receiving                    // a non-seeder waiting on or receiving mp3 frames
+	Relaying                     // seeding to the seedees we found
+	Playing                      // playing the song (and still relaying it)
+	Done                         // done playing; waiting on the next song
+)
+
+var songStateNames = []string{"idle", "handshaking", "receiving", "relaying", "playing", "done"}
+
+func (s SongState) String() string {
+	if s < 0 || int(s) >= len(songStateNames) {
+		return fmt.Sprintf("state(%d)", int(s))
+	}
+
+	return songStateNames[s]
+}
+
+// Legal song state transitions. Anything else is refused and logged.
+// Leaving the tracker takes any state back to idle.
+var songTransitions = map[SongState][]SongState{
+	Idle:        {Handshaking, Receiving},
+	Receiving:   {Handshaking, Playing, Idle}, // confirmed by a seeder, or its confirms got lost
+	Handshaking: {Relaying, Playing, Idle},    // still looking for seedees when the song starts
+	Relaying:    {Playing, Idle},
+	Playing:     {Done, Idle},
+	Done:        {Handshaking, Receiving, Idle},
+}
+
+// Our membership of a tracker's peer network, from join until leave
+type session struct {
+	p          *Peer
+	client     *rpc2.Client
+	packetConn net.PacketConn  // handshake packets
+	mediaConn  net.PacketConn  // mp3 frames, unless we're the source
+	addr       string          // ip:port the tracker knows us by
+	clock      clock.Estimator // our estimate of the tracker's clock
+	left       chan struct{}   // closed when we leave the tracker
+	stopOnce   sync.Once
+	recvMu     sync.Mutex   // held by the one listenForMp3 reading mediaConn
+	library    []proto.Song // songs the tracker knows we have; only watchSongs touches it
+
+	mu         sync.Mutex // guards everything below
+	state      SongState
+	song       proto.Song         // the current song
+	source     bool               // we have the current song locally
+	songStream *stream.Buffer     // frames of the current song, drained by the player
+	sendWindow *stream.SendWindow // packets we sent or relayed, for NACKs
+	songDone   chan struct{}      // closed when we're through with the current song
+	over       string             // hash of the song last aborted or played, until the tracker gives us a song
+	overAt     int                // pings when it was over
+	pings      int                // pings the tracker answered
+
+	// Seeder's data structures
+	peerToSeedees map[string]*seedeeConn // map of seedees to their paced udp conn
+	peerToConn    map[string]bool        // map of peers to a boolean if they responded to our request or not
+	peerToMedia   map[string]string      // map of peers we asked to the mp3 address they advertised
+	seedees       []string               // list of seedees' mp3 addresses
+}
+
+// Join the tracker at addr and register the rpcs that it can call
+func newSession(p *Peer, addr string) (*session, error) {
+	trackerConn, err := p.cfg.Network.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	packetConn, err := p.cfg.Network.ListenPacket("udp", net.JoinHostPort(p.cfg.Ip, strconv.Itoa(p.cfg.HandshakePort)))
+	if err != nil {
+		trackerConn.Close()
+		return nil, err
+	}
+
+	mediaConn, err := p.cfg.Network.ListenPacket("udp", net.JoinHostPort(p.cfg.Ip, strconv.Itoa(p.cfg.MediaPort)))
+	if err != nil {
+		packetConn.Close()
+		trackerConn.Close()
+		return nil, err
+	}
+
+	_, port, _ := net.SplitHostPort(trackerConn.LocalAddr().String())
+	s := &session{
+		p:             p,
+		client:        rpc2.NewClient(trackerConn),
+		packetConn:    packetConn,
+		mediaConn:     mediaConn,
+		addr:          net.JoinHostPort(p.cfg.Ip, port),
+		left:          make(chan struct{}),
+		peerToSeedees: make(map[string]*seedeeConn),
+		peerToConn:    make(map[string]bool),
+		peerToMedia:   make(map[string]string),
+		seedees:       make([]string, 0),
+	}
+
+	// Register the rpc handlers for seedToPeers() so that tracker can notify
+	// client when to start seeding
+	s.client.Handle("seed", func(client *rpc2.Client, args *proto.Song, reply *proto.HandshakePacket) error {
+		if s.assigned(*args, Handshaking) {
+			go s.seedToPeers(*args)
+		}
+		return nil
+	})
+
+	// Let tracker notify client to start listening for mp3 frames
+	s.client.Handle("listen-for-mp3", func(client *rpc2.Client, args *proto.Song, reply *proto.HandshakePacket) error {
+		if s.assigned(*args, Receiving) {
+			go s.listenForMp3()
+		}
+		return nil
+	})
+
+	// Let tracker notify client to start playing
+	s.client.Handle("start-playing", func(client *rpc2.Client, args *proto.TimePacket, reply *proto.HandshakePacket) error {
+		s.mu.Lock()
+		ok := s.transition(Playing)
+		song, songStream := s.song, s.songStream
+		s.mu.Unlock()
+
+		if !ok {
+			return nil
+		}
+
+		done := make(chan struct{})
+		go s.reportPosition(proto.SongId(song.Hash), done)
+
+		// Decode the song from the stream buffer as it is being filled,
+		// starting at the time the tracker picked for everyone;
+		// blocks until the song is over
+		err := s.p.player.PlayAt(song.Name, songStream, s.clock.ToLocal(args.TimeToPlay))
+		if err != nil && err != music.ErrStopped { // stopped: we left or it was skipped
+			log.Println(err)
+		}
+
+		close(done)
+
+		s.donePlaying()
+		return nil
+	})
+
+	// Let tracker tell us the song was skipped
+	s.client.Handle("abort", func(client *rpc2.Client, args *proto.Song, reply *proto.HandshakePacket) error {
+		s.abort(*args)
+		return nil
+	})
+
+	// Let tracker tell us where everyone else is in the song, so we can
+	// catch up or hold back
+	s.client.Handle("sync-position", func(client *rpc2.Client, args *proto.PositionMsg, reply *proto.HandshakePacket) error {
+		if args.SongId != proto.SongId(s.Song().Hash) || s.State() != Playing {
+			return nil
+		}
+
+		// where the reference is now, by the tracker's clock
+		ref := args.Position + s.clock.ToTracker(time.Now()).Sub(args.At)
+		drift := ref - s.p.player.Position() // > 0: we are behind
+		if drift > s.p.cfg.Drift || drift < -s.p.cfg.Drift {
+			s.p.player.Adjust(drift)
+		}
+
+		return nil
+	})
+
+	go s.client.Run()
+
+	go s.listenForPeers() // begin handling incoming handshake requests
+	go s.ping()           // begin continuous communication with tracker
+	go s.syncClock()      // keep estimating the tracker's clock offset
+	go s.disconnected()
+
+	s.library = p.songs()
+	s.client.Call("join", s.info(s.library), nil)
+
+	if p.cfg.ScanInterval > 0 {
+		go s.watchSongs()
+	}
+
+	return s, nil
+}
+
+// Who we are to the tracker: our address, songs and the ports we listen on
+func (s *session) info(songs []proto.Song) proto.ClientInfoMsg {
+	return proto.ClientInfoMsg{s.addr, songs, portOf(s.packetConn.LocalAddr()), portOf(s.mediaConn.LocalAddr()), s.p.cfg.Id}
+}
+
+// Port number of a socket address
+func portOf(addr net.Addr) int {
+	_, p, _ := net.SplitHostPort(addr.String())
+	n, _ := strconv.Atoi(p)
+	return n
+}
+
+// Leave the tracker, abandoning whatever song we were part of
+func (s *session) leave() {
+	if !s.stop() {
+		return
+	}
+
+	s.client.Call("leave", s.info(nil), nil)
+
+	time.Sleep(s.p.cfg.LeaveDelay)
+	s.packetConn.Close()
+	s.mediaConn.Close()
+	s.client.Close()
+}
+
+// Stop taking part in songs. Returns false if we already had.
+func (s *session) stop() bool {
+	stopped := false
+	s.stopOnce.Do(func() {
+		close(s.left)
+		s.p.player.Stop()
+
+		s.mu.Lock()
+		s.reset()
+		s.mu.Unlock()
+		stopped = true
+	})
+
+	return stopped
+}
+
+// The tracker hung up on us without us leaving
+func (s *session) disconnected() {
+	select {
+	case <-s.client.DisconnectNotify():
+	case <-s.left:
+		return
+	}
+
+	if s.stop() {
+		s.packetConn.Close()
+		s.mediaConn.Close()
+		s.p.emit(Event{Disconnected, proto.Song{}, Idle})
+	}
+}
+
+// Has the session not been left yet
+func (s *session) joined() bool {
+	select {
+	case <-s.left:
+		return false
+	default:
+		return true
+	}
+}
+
+// Current song state
+func (s *session) State() SongState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state
+}
+
+// Current song, zero while idle
+func (s *session) Song() proto.Song {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.song
+}
+
+// Start on a new song as a seeder (handshaking) or non-seeder (receiving).
+// The tracker repeats itself on every ping, so being told about the song
+// we're already on is not an error; it just returns false.
+func (s *session) begin(song proto.Song, to SongState) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.state != Idle && s.state != Done {
+		if song.Hash != s.song.Hash {
+			log.Printf("Error: told to start %s while %s %s\n", song.Name, s.state, s.song.Name)
+		}
+		return false
+	}
+
+	// Seeders that haven't heard it was skipped still ask us to take it
+	if song.Hash == s.over {
+		return false
+	}
+
+	prev := s.song
+	s.song = song
+	if !s.transition(to) {
+		s.song = prev
+		return false
+	}
+
+	s.source = to == Handshaking
+	s.songStream = stream.NewBuffer(s.p.cfg.BufferFrames)
+	s.sendWindow = stream.NewSendWindow(stream.DefaultSendWindow)
+	s.songDone = make(chan struct{})
+	s.peerToConn = make(map[string]bool)
+	s.peerToMedia = make(map[string]string)
+	s.seedees = make([]string, 0)
+	return true
+}
+
+// Start on a song the tracker told us about. The ping that was under way
+// when the last song was skipped or done playing may still tell us to start
+// that one; after that the tracker means it, even if it is the same song again.
+func (s *session) assigned(song proto.Song, to SongState) bool {
+	s.mu.Lock()
+	if song.Hash == s.over && s.pings == s.overAt {
+		s.mu.Unlock()
+		return false
+	}
+	s.over = ""
+
+	// The tracker moved on from a song we never got going on, i.e. one we
+	// joined in the middle of, that nobody streams to us
+	if s.state == Receiving && s.song.Hash != song.Hash {
+		log.Printf("Dropping %s; the tracker moved on to %s\n", s.song.Name, song.Name)
+		s.reset()
+	}
+	s.mu.Unlock()
+
+	return s.begin(song, to)
+}
+
+// Drop song midway if it is still the current one: stop playing, seeding
+// and relaying it and go back to idle for the next song
+func (s *session) abort(song proto.Song) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if song.Hash != s.song.Hash || s.state == Idle || s.state == Done {
+		return
+	}
+
+	if s.state == Playing {
+		s.p.player.Stop()
+	}
+	s.reset()
+	s.over, s.overAt = song.Hash, s.pings
+}
+
+// Do we have (or are we being streamed) the current song, i.e. should we
+// turn down handshake requests for it
+func (s *session) seeding() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state == Handshaking || s.state == Relaying || s.state == Playing
+}
+
+// Move to state to, refusing transitions the table doesn't allow.
+// Must hold mu.
+func (s *session) transition(to SongState) bool {
+	for _, t := range songTransitions[s.state] {
+		if t == to {
+			s.state = to
+			s.p.emit(Event{SongChanged, s.song, to})
+			return true
+		}
+	}
+
+	log.Printf("Error: illegal song transition %s -> %s\n", s.state, to)
+	return false
+}
+
+// Back to idle, e.g. when leaving the tracker or when the song is skipped.
+// Must hold mu.
+func (s *session) reset() {
+	s.teardown()
+	if s.state != Idle {
+		s.transition(Idle)
+	}
+	s.song = proto.Song{}
+}
+
+// Close everything we had for the current song. Must hold mu.
+func (s *session) teardown() {
+	if s.songStream != nil {
+		s.songStream.Close()
+	}
+
+	for _, c := range s.peerToSeedees {
+		c.Close()
+	}
+
+	if s.songDone != nil {
+		close(s.songDone)
+		s.songDone = nil
+	}
+
+	s.peerToSeedees = make(map[string]*seedeeConn)
+	s.peerToConn = make(map[string]bool)
+	s.peerToMedia = make(map[string]string)
+	s.seedees = make([]string, 0)
+	s.source = false
+}
+
+// Notify the tracker that we finished playing the song
+func (s *session) donePlaying() {
+	s.mu.Lock()
+	if s.state != Playing { // we left mid-song, or it was skipped
+		s.mu.Unlock()
+		return
+	}
+
+	song := s.song
+
+	s.teardown() // clean up connections
+	s.mu.Unlock()
+
+	// make rpc call to tracker. Only once it has heard us do we stop
+	// ignoring seed and listen-for-mp3 calls, or a ping racing with this
+	// could start the song we just played all over again; nor do we take
+	// the ones the ping under way now still brings
+	s.client.Call("done-playing", proto.ClientCmdMsg{song.Hash}, nil)
+
+	s.mu.Lock()
+	if s.state == Playing {
+		s.transition(Done)
+		s.over, s.overAt = song.Hash, s.pings
+	}
+	s.mu.Unlock()
+}
+
+// Method of continous communication between clients and tracker
+// Client constantly asking the tracker if the next song is ready.
+// The tracker evicts clients it stops hearing from.
+func (s *session) ping() {
+	for s.joined() {
+		s.client.Call("ping", s.info(nil), nil)
+
+		s.mu.Lock()
+		s.pings++
+		s.mu.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Estimate the offset between our clock and the tracker's NTP style,
+// and let the tracker know what we came up with
+func (s *session) syncClock() {
+	for s.joined() {
+		for i := 0; i < syncSamples && s.joined(); i++ {
+			var res proto.TimeSyncPacket
+			t0 := time.Now()
+			if err := s.client.Call("time-sync", proto.TimeSyncPacket{ClientSend: t0}, &res); err == nil {
+				s.clock.Add(clock.NewSample(t0, res.TrackerRecv, res.TrackerSend, time.Now()))
+			}
+			time.Sleep(syncSpacing)
+		}
+
+		if offset, rtt, ok := s.clock.Offset(); ok {
+			s.client.Call("clock-offset", proto.ClockMsg{s.addr, offset, rtt}, nil)
+		}
+
+		select {
+		case <-s.left:
+		case <-time.After(syncInterval):
+		}
+	}
+}
+
+// Tell the tracker how far into the song we are until done is closed
+func (s *session) reportPosition(songId uint32, done chan struct{}) {
+	t := time.NewTicker(positionInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+		}
+
+		pos := s.p.player.Position()
+		if pos == 0 { // not started yet
+			continue
+		}
+
+		msg := proto.PositionMsg{s.addr, songId, pos, s.clock.ToTracker(time.Now())}
+		s.client.Call("position", msg, nil)
+	}
+}
@@ -0,0 +1,217 @@
+package peer
+
+import (
+	"os"
+	"io"
+	"log"
+	"fmt"
+	"sort"
+	"strings"
+	"path/filepath"
+	"crypto/sha256"
+	"encoding/hex"
+	"mob/proto"
+	"mob/client/tags"
+	"github.com/tcolgate/mp3"
+	"time"
+)
+
+// A hashed song file, remembered so it is only hashed again once it changes
+type songFile struct {
+	size    int64
+	modTime time.Time
+	song    proto.Song
+}
+
+// Returns all songs in our songs folder, by path. Only joining and
+// watchSongs scan; everything else looks songs up as of the last scan.
+func (p *Peer) scanSongs() map[string]proto.Song {
+	found := make(map[string]os.FileInfo)
+	filepath.Walk(p.cfg.SongsDir, func(path string, i os.FileInfo, err error) error {
+		if err != nil {
+			log.Println(err)
+			return nil
+		}
+
+		if !i.IsDir() && strings.Contains(filepath.Base(path), ".mp3") {
+			found[path] = i
+		}
+
+		return nil
+	})
+
+	p.songsMu.Lock()
+	defer p.songsMu.Unlock()
+
+	songs := make(map[string]proto.Song)
+	for path, i := range found {
+		f, ok := p.songFiles[path]
+		if !ok || f.size != i.Size() || !f.modTime.Equal(i.ModTime()) {
+			song, err := readSong(path)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+
+			f = songFile{i.Size(), i.ModTime(), song}
+			p.songFiles[path] = f
+		}
+
+		songs[path] = f.song
+	}
+
+	// forget files that are gone
+	for path := range p.songFiles {
+		if _, ok := found[path]; !ok {
+			delete(p.songFiles, path)
+		}
+	}
+
+	p.songPaths = make(map[string]string)
+	for path, song := range songs {
+		if had, ok := p.songPaths[song.Hash]; !ok || path < had {
+			p.songPaths[song.Hash] = path
+		}
+	}
+
+	return songs
+}
+
+// Our songs, one of each, by name. A song we have more than one copy of
+// goes by its copy at the lowest path, the one songPath streams, so the
+// same folder always gives the same songs.
+func (p *Peer) songs() []proto.Song {
+	found := p.scanSongs()
+	paths := make([]string, 0, len(found))
+	for path := range found {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	seen := make(map[string]bool)
+	var songs []proto.Song
+	for _, path := range paths {
+		if song := found[path]; !seen[song.Hash] {
+			seen[song.Hash] = true
+			songs = append(songs, song)
+		}
+	}
+
+	sort.Slice(songs, func(i, j int) bool { return songs[i].Name < songs[j].Name })
+	return songs
+}
+
+// Where we have the song with the given hash, if we do
+func (p *Peer) songPath(hash string) (string, bool) {
+	p.songsMu.Lock()
+	defer p.songsMu.Unlock()
+
+	path, ok := p.songPaths[hash]
+	return path, ok
+}
+
+func (p *Peer) hasSong(hash string) bool {
+	_, ok := p.songPath(hash)
+	return ok
+}
+
+// Read what we tell the tracker about a song file: its tags, what its mp3
+// frames add up to, and what identifies it, the sha-256 of those frames,
+// so that neither its file name nor its tags change which song it is
+func readSong(path string) (proto.Song, error) {
+	song := proto.Song{Name: filepath.Base(path)}
+
+	r, err := os.Open(path)
+	if err != nil {
+		return song, err
+	}
+
+	defer r.Close()
+
+	t, err := tags.Read(r)
+	if err != nil {
+		log.Printf("%s: %v\n", path, err) // the audio is still fine
+	}
+	song.Title, song.Artist, song.Album = t.Title, t.Artist, t.Album
+
+	if err := tags.SkipID3v2(r); err != nil {
+		return song, err
+	}
+
+	h := sha256.New()
+	d := mp3.NewDecoder(r)
+	skipped := 0
+	frames := 0
+	bitrates := 0
+	var frame mp3.Frame
+	for d.Decode(&frame, &skipped) == nil {
+		io.Copy(h, frame.Reader())
+
+		if frames == 0 {
+			song.SampleRate = int(frame.Header().SampleRate())
+		}
+		song.Duration += frame.Duration()
+		bitrates += int(frame.Header().BitRate()) / 1000
+		frames++
+	}
+
+	if frames == 0 {
+		return song, fmt.Errorf("%s: no mp3 frames", path)
+	}
+
+	song.Bitrate = bitrates / frames
+	song.Hash = hex.EncodeToString(h.Sum(nil))
+	return song, nil
+}
+
+// Keep the tracker up to date with the songs in our songs folder, so songs
+// copied in (or deleted) after we joined can be played
+func (s *session) watchSongs() {
+	t := time.NewTicker(s.p.cfg.ScanInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-s.left:
+			return
+		case <-t.C:
+		}
+
+		// A renamed song is removed and added back under its new name
+		songs := s.p.songs()
+		added, removed := diffSongs(s.library, songs)
+		if len(removed) > 0 {
+			s.client.Call("remove-songs", s.info(removed), nil)
+		}
+		if len(added) > 0 {
+			s.client.Call("add-songs", s.info(added), nil)
+		}
+
+		s.library = songs
+	}
+}
+
+// Songs in now but not in before, and the other way around
+func diffSongs(before []proto.Song, now []proto.Song) ([]proto.Song, []proto.Song) {
+	had := make(map[proto.Song]bool)
+	for _, song := range before {
+		had[song] = true
+	}
+
+	var added []proto.Song
+	for _, song := range now {
+		if !had[song] {
+			added = append(added, song)
+		}
+		delete(had, song)
+	}
+
+	var removed []proto.Song
+	for _, song := range before {
+		if had[song] {
+			removed = append(removed, song)
+		}
+	}
+
+	return added, removed
+}
@@ -0,0 +1,618 @@
+package peer
+
+import (
+	"os"
+	"io/ioutil"
+	"log"
+	"strings"
+	"strconv"
+	"net"
+	"mob/proto"
+	"mob/client/stream"
+	"mob/client/tags"
+	"github.com/tcolgate/mp3"
+	"time"
+	"sync"
+	"errors"
+	"bytes"
+)
+
+// Once frames have started arriving, a seeder going quiet for this long
+// means the song is over
+const songIdleTimeout = 3 * time.Second
+
+// How often a seedee NACKs the frames it is missing
+const nackInterval = 50 * time.Millisecond
+
+// Packets waiting to go out to one seedee
+const seedeeQueueLen = 256
+
+// How long a seeder asks a peer to take the song before counting it as
+// turned down, i.e. because it left
+const requestTimeout = 2 * time.Second
+
+// Frames buffered before we tell the tracker we're ready to play
+const prebufferFrames = 300
+
+// Tell the tracker we're ready to play song once b holds prebufferFrames of
+// it, as many as b holds if that's fewer (writes block once it's full), or
+// the whole song if it's shorter. Gives up if the song is dropped.
+func (s *session) readyWhenBuffered(song proto.Song, b *stream.Buffer) {
+	n := prebufferFrames
+	if b.Cap() < n {
+		n = b.Cap()
+	}
+
+	if b.WaitWritten(n) && s.joined() {
+		s.client.Call("ready-to-play", proto.ClientCmdMsg{song.Hash}, nil)
+	}
+}
+
+// Call this if we're not a source seeder (has song locally) after we set our seedees
+func (s *session) listenForMp3() {
+	// the last song's listener may not have noticed it's over yet
+	s.recvMu.Lock()
+	defer s.recvMu.Unlock()
+
+	s.mu.Lock()
+	if s.state == Idle || s.state == Done { // left before we got going
+		s.mu.Unlock()
+		return
+	}
+	currentSong, songStream, sendWindow, songDone := s.song, s.songStream, s.sendWindow, s.songDone
+	s.mu.Unlock()
+
+	mp3Conn := s.mediaConn
+
+	songId := proto.SongId(currentSong.Hash)
+	reassembler := stream.NewReassembler(songStream, stream.DefaultWindow)
+	fec := stream.NewFECDecoder()
+	go s.readyWhenBuffered(currentSong, songStream)
+
+	seeder := ""            // ip:port frames come from
+	var seederAddr net.Addr // where to send NACKs
+	lastPacket := time.Now()
+	lastNack := time.Now()
+
+	// Continously listen mp3 packets while connected to tracker
+recv:
+	for s.joined() { // terminate when we leave a tracker
+		select {
+		case <-songDone:
+			break recv
+		default:
+		}
+
+		if reassembler.Done() { // got every frame of the song
+			songStream.CloseWrite()
+			break
+		}
+
+		// Ask our seeder to resend whatever we are missing. Once it has gone
+		// quiet, the frames at the end of the song count as missing too.
+		if s.p.cfg.Nacks && seederAddr != nil && time.Since(lastNack) >= nackInterval {
+			quiet := time.Since(lastPacket) > 4*nackInterval
+			if missing := reassembler.Missing(proto.MaxNackSeqs, quiet); len(missing) > 0 {
+				nack := proto.NewNack(songId, missing)
+				mp3Conn.WriteTo(nack.Encode(), seederAddr)
+			}
+			lastNack = time.Now()
+		}
+
+		buf := make([]byte, 2048)
+
+		// Read a packet
+		mp3Conn.SetReadDeadline(time.Now().Add(nackInterval))
+		n, addr, err := mp3Conn.ReadFrom(buf) // block here
+		if e, ok := err.(net.Error); ok && e.Timeout() {
+			if seeder != "" && time.Since(lastPacket) > songIdleTimeout {
+				// seeder went quiet; whatever we have is the whole song
+				reassembler.Flush()
+				songStream.CloseWrite()
+				break
+			}
+			continue
+		}
+
+		if err != nil {
+			break // this will happen when we leave the tracker
+		}
+
+		pkt, err := proto.DecodeMp3Packet(buf[:n])
+		if err != nil {
+			log.Println("Error: dropping mp3 packet:", err)
+			continue
+		}
+
+		if pkt.SongId != songId {
+			continue // stale packet from another song
+		}
+
+		if seeder == "" {
+			seeder = addr.String()
+			seederAddr = addr
+		}
+
+		if addr.String() != seeder {
+			continue
+		}
+
+		lastPacket = time.Now()
+		reassembler.SetTotal(pkt.Frames)
+
+		// A frame we got, or one we rebuilt from parity
+		var seq uint32
+		var frame []byte
+		recovered := false
+
+		switch pkt.Type {
+		case proto.PacketFrame:
+			// Relay to our seedees, remembering the packet in case they lose it
+			sendWindow.Put(pkt.Seq, buf[:n])
+			s.sendToSeedees(buf[:n], frameDuration(pkt.Payload))
+
+			if err := reassembler.Add(pkt.Seq, pkt.Payload); err == stream.ErrClosed {
+				break recv
+			} else if err != nil {
+				log.Println("Error: dropping mp3 frame:", err)
+			}
+
+			seq, frame, recovered = fec.AddFrame(pkt.Seq, pkt.Payload)
+		case proto.PacketParity:
+			s.sendToSeedees(buf[:n], 0)
+			seq, frame, recovered = fec.AddParity(pkt.Seq, pkt.Payload)
+		}
+
+		if recovered {
+			// Pass the rebuilt frame on as if our seeder had sent it
+			packet := proto.Mp3Packet{proto.PacketFrame, songId, seq, pkt.Frames, frame}
+			b := packet.Encode()
+			sendWindow.Put(seq, b)
+			s.sendToSeedees(b, frameDuration(frame))
+
+			if err := reassembler.Add(seq, frame); err == stream.ErrClosed {
+				break
+			}
+		}
+	}
+
+	fec.Flush()
+	if fec.Recovered > 0 || fec.Unrecoverable > 0 {
+		log.Printf("fec: recovered %d frames of %s, %d unrecoverable\n", fec.Recovered, currentSong.Name, fec.Unrecoverable)
+	}
+
+	if reassembler.Skipped > 0 {
+		log.Printf("lost %d frames of %s\n", reassembler.Skipped, currentSong.Name)
+	}
+}
+
+// Listens for udp request packets from peers in order to build the stream graph
+// Handles all possible handshake packets that will be sent to this peer.
+// Started when we join a tracker
+func (s *session) listenForPeers() {
+	// Continously listen for handshake packets
+	// Eventually after a successful round of handshaking, all peers will
+	// be seeders and will block on the next ReadFrom() call until the next
+	// round
+	for s.joined() { // terminate when we leave a tracker
+		// Read a packet
+		buffer := make([]byte, 2048)
+		n, addr, e := s.packetConn.ReadFrom(buffer) // block here
+		if e != nil {
+			break
+		}
+
+		// Replies go back to the handshake port the packet came from.
+		// Packets are request:hash:name or type:hash;
+		// answers name the song so that a late one about the last song
+		// isn't taken for one about this one.
+		substrs := strings.SplitN(string(buffer[:n]), ":", 3)
+		from := addr.String()
+
+		// Process the packet and handle
+		switch substrs[0] {
+		case "request": // where this client is a non-seeder
+			if len(substrs) < 3 {
+				continue
+			}
+
+			song := proto.Song{Hash: substrs[1], Name: substrs[2]}
+			if s.seeding() || s.p.hasSong(song.Hash) {
+				s.packetConn.WriteTo([]byte("reject:"+song.Hash), addr)
+				continue
+			}
+
+			// The seeder may beat the tracker to telling us about the song
+			if s.begin(song, Receiving) {
+				go s.listenForMp3()
+			}
+
+			s.mu.Lock()
+			taking := s.state == Receiving && s.song.Hash == song.Hash
+			s.mu.Unlock()
+
+			if taking { // tell the seeder where to stream to
+				s.packetConn.WriteTo([]byte("accept:"+song.Hash), addr)
+			} else { // still on another song, i.e. one we joined too late for, or just played it
+				s.packetConn.WriteTo([]byte("reject:"+song.Hash), addr)
+			}
+		case "confirm": // where this client is a non-seeder
+			if len(substrs) < 2 {
+				continue
+			}
+
+			s.mu.Lock()
+			current := substrs[1] == s.song.Hash
+			confirmed := current && s.state == Receiving && s.transition(Handshaking)
+			song := s.song
+			s.mu.Unlock()
+
+			if confirmed {
+				go s.seedToPeers(song)
+			} else if current { // if we already confirmed, don't reject a confirm from our origin
+				go func() {
+					for i := 0; i < 5; i++ { // redundancy
+						s.packetConn.WriteTo([]byte("reject:"+song.Hash), addr)
+						time.Sleep(500 * time.Microsecond)
+					}
+				}()
+			}
+		case "accept": // where this client is a seeder
+			s.mu.Lock()
+			media, asked := s.peerToMedia[from]
+			if len(substrs) < 2 || substrs[1] != s.song.Hash || !asked { // about another song
+				s.mu.Unlock()
+				continue
+			}
+
+			s.peerToConn[from] = true
+			switch {
+			case s.state == Idle || s.state == Receiving || s.state == Done:
+				// is a non-seeder; shouldn't get here; sanity check
+				log.Printf("Error: %s accepted while %s\n", from, s.state)
+			case s.state != Handshaking || s.hasSeedee(media):
+				// late answer to one of our repeated requests
+			case len(s.seedees) < s.p.cfg.MaxSeedees:
+				s.seedees = append(s.seedees, media)
+				confirm := []byte("confirm:" + s.song.Hash)
+				go func() {
+					for i := 0; i < 5; i++ { // redundancy
+						s.packetConn.WriteTo(confirm, addr)
+						time.Sleep(500 * time.Microsecond)
+					}
+				}()
+			}
+			s.mu.Unlock()
+		case "reject": // where this client is a seeder
+			s.mu.Lock()
+			if len(substrs) > 1 && substrs[1] == s.song.Hash {
+				s.peerToConn[from] = true
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+// If this client has access to mp3 stream, find peers to stream to.
+// Broadcasts packets to peers until every peer has responded.
+// Called by tracker rpc.
+func (s *session) seedToPeers(song proto.Song) {
+	var wg sync.WaitGroup
+
+	s.mu.Lock()
+	songDone := s.songDone
+	s.mu.Unlock()
+
+	if songDone == nil { // dropped before we got going
+		return
+	}
+
+	// Get list of peers from tracker
+	var peers proto.PeerList
+	s.client.Call("list-peers", proto.ClientCmdMsg{""}, &peers)
+
+	// Send requests to the handshake ports all other peers advertised; the
+	// ones that accept get frames on the media port they advertised
+	for _, peer := range peers.Peers {
+		if peer.Addr != s.addr { // check not this client
+			ip, _, _ := net.SplitHostPort(peer.Addr)
+			raddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(ip, strconv.Itoa(peer.HandshakePort)))
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+
+			// Replies come back from the same address
+			key := raddr.String()
+			s.mu.Lock()
+			s.peerToConn[key] = false
+			s.peerToMedia[key] = net.JoinHostPort(ip, strconv.Itoa(peer.MediaPort))
+			s.mu.Unlock()
+
+			wg.Add(1)
+			// ARQ requests to the peer until we set its response bool to nil
+			go func() {
+				defer wg.Done()
+				deadline := time.Now().Add(requestTimeout)
+				for s.joined() {
+					// or the song was skipped; a late answer would be taken
+					// for one about the next song
+					s.mu.Lock()
+					responded := s.peerToConn[key] || s.songDone != songDone
+					s.mu.Unlock()
+					if responded {
+						break
+					}
+
+					if time.Now().After(deadline) { // as good as a reject
+						log.Printf("%s never answered our request for %s\n", key, song.Name)
+						break
+					}
+
+					s.packetConn.WriteTo([]byte("request:"+song.Hash+":"+song.Name), raddr)
+					time.Sleep(500 * time.Microsecond)
+				}
+			}()
+		}
+	}
+
+	wg.Wait() // wait until we get a response from every peer
+
+	s.mu.Lock()
+	if s.song != song || (s.state != Handshaking && s.state != Playing) { // left mid-handshake
+		s.mu.Unlock()
+		return
+	}
+
+	// Dial the mp3 port each seedee advertised
+	for _, seedee := range s.seedees {
+		c, err := s.p.cfg.Network.Dial("udp", seedee)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		s.peerToSeedees[seedee] = newSeedeeConn(c, s.p.cfg.Pace, s.p.cfg.Burst)
+		go serveNacks(c, proto.SongId(song.Hash), s.sendWindow)
+	}
+
+	if s.state == Handshaking { // else we keep relaying while we play
+		s.transition(Relaying)
+	}
+
+	isSourceSeeder, songStream, sendWindow := s.source, s.songStream, s.sendWindow
+	s.mu.Unlock()
+
+	if !isSourceSeeder {
+		// Frames we relayed while still handshaking went to nobody; catch our
+		// seedees up on whatever we still have
+		for _, b := range sendWindow.Packets() {
+			if pkt, err := proto.DecodeMp3Packet(b); err == nil {
+				s.sendToSeedees(b, frameDuration(pkt.Payload))
+			}
+		}
+	}
+
+	if isSourceSeeder {
+		// Count the frames up front so seedees know when the song is complete
+		path, ok := s.p.songPath(song.Hash)
+		if !ok {
+			log.Printf("Error: told to seed %s, which we no longer have\n", song.Name)
+			return
+		}
+
+		total, err := countFrames(path)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+
+		r, err := os.Open(path)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+
+		defer r.Close()
+
+		if err := tags.SkipID3v2(r); err != nil {
+			log.Println(err)
+			return
+		}
+
+		d := mp3.NewDecoder(r)
+
+		skipped := 0
+		songId := proto.SongId(song.Hash)
+		var seq uint32
+		var frame mp3.Frame
+
+		var fec *stream.FECEncoder
+		if s.p.cfg.FEC > 0 {
+			fec = stream.NewFECEncoder(s.p.cfg.FEC)
+		}
+
+		go s.readyWhenBuffered(song, songStream)
+		for s.joined() {
+			if err := d.Decode(&frame, &skipped); err != nil {
+				break
+			}
+
+			reader := frame.Reader()
+			frame_bytes, _ := ioutil.ReadAll(reader)
+
+			packet := proto.Mp3Packet{proto.PacketFrame, songId, seq, total, frame_bytes}
+			b := packet.Encode()
+			sendWindow.Put(seq, b)
+			s.sendToSeedees(b, frame.Duration())
+
+			if fec != nil {
+				if start, parity, ok := fec.Add(seq, frame_bytes); ok {
+					p := proto.Mp3Packet{proto.PacketParity, songId, start, total, parity}
+					s.sendToSeedees(p.Encode(), 0)
+				}
+			}
+
+			seq++
+
+			// Write frame into our own stream buffer; blocks while it is full
+			if err := songStream.Write(frame_bytes); err == stream.ErrClosed {
+				break
+			} else if err != nil {
+				log.Println("Error: skipping mp3 frame:", err)
+				continue
+			}
+		}
+
+		if fec != nil {
+			if start, parity, ok := fec.Flush(); ok {
+				p := proto.Mp3Packet{proto.PacketParity, songId, start, total, parity}
+				s.sendToSeedees(p.Encode(), 0)
+			}
+		}
+
+		songStream.CloseWrite()
+	}
+}
+
+// Must hold mu
+func (s *session) hasSeedee(addr string) bool {
+	for _, seedee := range s.seedees {
+		if seedee == addr {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Queue a packet carrying d worth of audio for each of our seedees
+func (s *session) sendToSeedees(b []byte, d time.Duration) {
+	s.mu.Lock()
+	conns := make([]*seedeeConn, 0, len(s.peerToSeedees))
+	for _, c := range s.peerToSeedees {
+		conns = append(conns, c)
+	}
+	s.mu.Unlock()
+
+	for _, c := range conns {
+		c.send(b, d)
+	}
+}
+
+// A seedee we stream to. Packets are queued and written out by their own
+// goroutine, metered by a token bucket, so a slow seedee doesn't hold back
+// the others until its queue fills up.
+type seedeeConn struct {
+	conn  net.Conn
+	pacer *stream.Pacer
+	queue chan pacedPacket
+	done  chan struct{}
+	once  sync.Once
+}
+
+type pacedPacket struct {
+	b []byte
+	d time.Duration // audio carried by the packet
+}
+
+func newSeedeeConn(c net.Conn, pace float64, burst time.Duration) *seedeeConn {
+	s := &seedeeConn{
+		conn:  c,
+		pacer: stream.NewPacer(pace, burst),
+		queue: make(chan pacedPacket, seedeeQueueLen),
+		done:  make(chan struct{}),
+	}
+
+	go s.run()
+	return s
+}
+
+func (s *seedeeConn) run() {
+	for {
+		select {
+		case p := <-s.queue:
+			s.pacer.Wait(p.d)
+			s.conn.Write(p.b)
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// Blocks while the seedee's queue is full
+func (s *seedeeConn) send(b []byte, d time.Duration) {
+	select {
+	case s.queue <- pacedPacket{b, d}:
+	case <-s.done:
+	}
+}
+
+func (s *seedeeConn) Close() {
+	s.once.Do(func() {
+		close(s.done)
+		s.conn.Close()
+	})
+}
+
+// Resend the frames a seedee NACKs for as long as we stream to it.
+// Returns once the connection is closed at the end of the song, or fails
+// for good, i.e. because the seedee's port is gone.
+func serveNacks(c net.Conn, songId uint32, sendWindow *stream.SendWindow) {
+	buf := make([]byte, 2048)
+	for {
+		n, err := c.Read(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("No longer taking NACKs from %s: %v\n", c.RemoteAddr(), err)
+			}
+			return
+		}
+
+		pkt, err := proto.DecodeMp3Packet(buf[:n])
+		if err != nil || pkt.Type != proto.PacketNack || pkt.SongId != songId {
+			continue
+		}
+
+		for _, seq := range pkt.NackSeqs() {
+			if b, ok := sendWindow.Get(seq); ok {
+				c.Write(b)
+			}
+		}
+	}
+}
+
+// Playing time of an mp3 frame, 0 if it doesn't parse
+func frameDuration(b []byte) time.Duration {
+	var frame mp3.Frame
+	skipped := 0
+	if err := mp3.NewDecoder(bytes.NewReader(b)).Decode(&frame, &skipped); err != nil {
+		return 0
+	}
+
+	return frame.Duration()
+}
+
+// Number of mp3 frames in the given song file
+func countFrames(path string) (uint32, error) {
+	r, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+
+	defer r.Close()
+
+	if err := tags.SkipID3v2(r); err != nil {
+		return 0, err
+	}
+
+	d := mp3.NewDecoder(r)
+	skipped := 0
+	var frame mp3.Frame
+	var n uint32
+	for d.Decode(&frame, &skipped) == nil {
+		n++
+	}
+
+	return n, nil
+}
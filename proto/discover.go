@@ -0,0 +1,85 @@
+package proto
+
+import (
+	"encoding/json"
+	"net"
+	"strings"
+)
+
+// LAN tracker discovery.
+//
+// A client broadcasts DiscoveryProbe over UDP to DiscoveryPort; every tracker
+// listening there answers the sender with a JSON encoded TrackerAnnouncement.
+// The tracker's ip is the address the answer came from.
+
+const DiscoveryPort = 6120
+const DiscoveryProbe = "mob-discover"
+
+type TrackerAnnouncement struct {
+	Name  string
+	Port  int // tcp port to join on
+	Peers int // peers connected to the tracker
+}
+
+func (a *TrackerAnnouncement) Encode() []byte {
+	b, _ := json.Marshal(a)
+	return b
+}
+
+func DecodeTrackerAnnouncement(b []byte) (TrackerAnnouncement, error) {
+	var a TrackerAnnouncement
+	err := json.Unmarshal(b, &a)
+	return a, err
+}
+
+// Where to send discovery probes so they reach every tracker on our LANs:
+// the broadcast address, the directed broadcast address of each of our
+// networks (or only iface's, if set) and loopback for one-machine setups
+func BroadcastAddrs(iface string) []string {
+	addrs := []string{"255.255.255.255"}
+
+	var ifaces []net.Interface
+	if iface != "" {
+		if i, err := net.InterfaceByName(iface); err == nil {
+			ifaces = []net.Interface{*i}
+		}
+	} else {
+		ifaces, _ = net.Interfaces()
+	}
+
+	for _, i := range ifaces {
+		if i.Flags&net.FlagUp == 0 || i.Flags&net.FlagBroadcast == 0 {
+			continue
+		}
+
+		ifAddrs, err := i.Addrs()
+		if err != nil {
+			continue
+		}
+
+		for _, addr := range ifAddrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if !ok || ipnet.IP.To4() == nil {
+				continue
+			}
+
+			ip, mask := ipnet.IP.To4(), ipnet.Mask
+			if len(mask) == net.IPv6len {
+				mask = mask[12:]
+			}
+
+			bcast := make(net.IP, net.IPv4len)
+			for j := range bcast {
+				bcast[j] = ip[j] | ^mask[j]
+			}
+			addrs = append(addrs, bcast.String())
+		}
+	}
+
+	return append(addrs, "127.0.0.1")
+}
+
+// Is b a discovery probe
+func IsDiscoveryProbe(b []byte) bool {
+	return strings.TrimSpace(string(b)) == DiscoveryProbe
+}
@@ -0,0 +1,129 @@
+package proto
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"hash/fnv"
+)
+
+// Binary framing for the mp3 frames streamed over UDP between peers.
+//
+// Every packet starts with a fixed header (big endian):
+//
+//	version  uint8
+//	type     uint8
+//	song id  uint32
+//	seq      uint32  sequence number of the frame within the song
+//	frames   uint32  total frames in the song, 0 if unknown
+//	checksum uint32  crc32 of the header (checksum zeroed) and payload
+//
+// followed by the mp3 frame itself.
+//
+// Seedees send NACK packets with the same header back to their seeder, whose
+// payload is a list of uint32 sequence numbers they are missing.
+//
+// With forward error correction on, seeders also send parity packets whose seq
+// is the first frame of the group they cover (see client/stream/fec.go).
+
+const Mp3PacketVersion = 1
+const Mp3HeaderSize = 18
+
+// Packet types
+const (
+	PacketFrame  uint8 = 1 // payload is one mp3 frame
+	PacketNack   uint8 = 2 // payload is a list of seqs to resend
+	PacketParity uint8 = 3 // payload is xor parity over a group of frames
+)
+
+// Most sequence numbers carried by one NACK
+const MaxNackSeqs = 256
+
+var (
+	ErrShortPacket = errors.New("proto: packet shorter than header")
+	ErrBadVersion  = errors.New("proto: unsupported packet version")
+	ErrChecksum    = errors.New("proto: packet checksum mismatch")
+)
+
+type Mp3Packet struct {
+	Type    uint8
+	SongId  uint32
+	Seq     uint32
+	Frames  uint32
+	Payload []byte
+}
+
+// Serialize the packet, header first
+func (p *Mp3Packet) Encode() []byte {
+	b := make([]byte, Mp3HeaderSize+len(p.Payload))
+	b[0] = Mp3PacketVersion
+	b[1] = p.Type
+	binary.BigEndian.PutUint32(b[2:], p.SongId)
+	binary.BigEndian.PutUint32(b[6:], p.Seq)
+	binary.BigEndian.PutUint32(b[10:], p.Frames)
+	copy(b[Mp3HeaderSize:], p.Payload)
+	binary.BigEndian.PutUint32(b[14:], checksum(b))
+	return b
+}
+
+// Parse a packet read off the wire. The payload aliases b.
+func DecodeMp3Packet(b []byte) (Mp3Packet, error) {
+	var p Mp3Packet
+	if len(b) < Mp3HeaderSize {
+		return p, ErrShortPacket
+	}
+
+	if b[0] != Mp3PacketVersion {
+		return p, ErrBadVersion
+	}
+
+	if binary.BigEndian.Uint32(b[14:]) != checksum(b) {
+		return p, ErrChecksum
+	}
+
+	p.Type = b[1]
+	p.SongId = binary.BigEndian.Uint32(b[2:])
+	p.Seq = binary.BigEndian.Uint32(b[6:])
+	p.Frames = binary.BigEndian.Uint32(b[10:])
+	p.Payload = b[Mp3HeaderSize:]
+	return p, nil
+}
+
+// Build a NACK asking for the given frames of a song
+func NewNack(songId uint32, seqs []uint32) Mp3Packet {
+	if len(seqs) > MaxNackSeqs {
+		seqs = seqs[:MaxNackSeqs]
+	}
+
+	payload := make([]byte, 4*len(seqs))
+	for i, seq := range seqs {
+		binary.BigEndian.PutUint32(payload[4*i:], seq)
+	}
+
+	return Mp3Packet{Type: PacketNack, SongId: songId, Payload: payload}
+}
+
+// Sequence numbers requested by a NACK packet
+func (p *Mp3Packet) NackSeqs() []uint32 {
+	seqs := make([]uint32, len(p.Payload)/4)
+	for i := range seqs {
+		seqs[i] = binary.BigEndian.Uint32(p.Payload[4*i:])
+	}
+
+	return seqs
+}
+
+// Short id for a song that tags every packet streamed for it
+func SongId(song string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(song))
+	return h.Sum32()
+}
+
+// crc32 over the packet with the checksum field treated as zero
+func checksum(b []byte) uint32 {
+	var zero [4]byte
+	c := crc32.ChecksumIEEE(b[:14])
+	c = crc32.Update(c, crc32.IEEETable, zero[:])
+	return crc32.Update(c, crc32.IEEETable, b[Mp3HeaderSize:])
+}
@@ -1,6 +1,7 @@
 package proto
 
 import (
+	"fmt"
 	"time"
 	"net"
 )
@@ -8,8 +9,71 @@ import (
 // Structs for our packet types
 
 type ClientInfoMsg struct {
-	Ip string
-	List []string
+	Ip    string
+	Songs []Song
+
+	HandshakePort int // where we take handshake packets
+	MediaPort     int // where we take mp3 frames
+
+	Id string // who we are, the same across rejoins; Ip if empty
+}
+
+// A song in the catalog. The same audio under different file names is the
+// same song; Name is only for showing.
+type Song struct {
+	Hash string // hex sha-256 of the song's mp3 frames, tags left out
+	Name string // file name
+
+	// From the file's ID3 tags; empty if it has none
+	Title  string
+	Artist string
+	Album  string
+
+	// From its mp3 frames
+	Duration   time.Duration
+	Bitrate    int // kbps, averaged over the frames
+	SampleRate int // Hz
+}
+
+// Enough of the hash to tell songs apart by eye
+func (s Song) ShortHash() string {
+	if len(s.Hash) < 8 {
+		return s.Hash
+	}
+
+	return s.Hash[:8]
+}
+
+type SongList struct {
+	Songs []Song
+}
+
+// The tracker's song queue
+type QueueList struct {
+	Current Song     // zero while idle
+	Songs   []Song   // up next, in order
+	Scores  []int    // votes on balance on each of Songs
+	Owners  []string // the peer that enqueued each of Songs
+}
+
+// A song in the queue by its position among the songs up next, from 1
+type QueueCmdMsg struct {
+	Pos int
+	To  int // where move puts it
+}
+
+// A peer's vote on a song up next
+type VoteMsg struct {
+	Pos  int // among the songs up next, from 1
+	Vote int // 1 up, -1 down
+}
+
+// Where the votes to skip the current song stand
+type SkipVote struct {
+	Song    Song
+	Votes   int
+	Needed  int
+	Skipped bool // the votes were enough
 }
 
 type ClientCmdMsg struct {
@@ -20,10 +84,6 @@ type TrackerRes struct {
 	Res string
 }
 
-type TrackerSlice struct {
-	Res []string
-}
-
 type ClientInfoPacket struct {
 	ClientIps []string
 }
@@ -36,19 +96,112 @@ type TimePacket struct {
 	TimeToPlay time.Time
 }
 
-// Return our discovered local ip address by pinging google
-func GetLocalIp() (string, error) {
-	conn, err1 := net.Dial("udp", "www.google.com:80")
-	if err1 != nil {
-		return "", err1
+// time-sync rpc; the client fills in ClientSend, the tracker the rest
+type TimeSyncPacket struct {
+	ClientSend  time.Time
+	TrackerRecv time.Time
+	TrackerSend time.Time
+}
+
+// A client's estimate of the tracker's clock relative to its own
+type ClockMsg struct {
+	Ip     string
+	Offset time.Duration // tracker clock minus client clock
+	RTT    time.Duration
+}
+
+// Playback position of a song. Clients report theirs to the tracker, which
+// broadcasts a reference position back to everyone. At is on the tracker's clock.
+type PositionMsg struct {
+	Ip       string
+	SongId   uint32
+	Position time.Duration
+	At       time.Time
+}
+
+type PeerInfo struct {
+	Addr   string
+	Offset time.Duration // last reported clock offset to the tracker
+	RTT    time.Duration
+
+	HandshakePort int // udp ports the peer advertised when it joined
+	MediaPort     int
+}
+
+type PeerList struct {
+	Peers []PeerInfo
+}
+
+// Return our local ip address, found by going through our network interfaces
+// rather than out on the network so that it works offline. Prefers a private
+// ipv4 address (i.e. 192.168.0.106) of an interface that is up. If iface is
+// set only that interface is considered. With nothing better around we fall
+// back to loopback, so the tracker and clients can all run on one machine.
+func GetLocalIp(iface string) (string, error) {
+	var ifaces []net.Interface
+	if iface != "" {
+		i, err := net.InterfaceByName(iface)
+		if err != nil {
+			return "", err
+		}
+		ifaces = []net.Interface{*i}
+	} else {
+		var err error
+		if ifaces, err = net.Interfaces(); err != nil {
+			return "", err
+		}
+	}
+
+	best, bestRank := "", 0
+	for _, i := range ifaces {
+		if i.Flags&net.FlagUp == 0 {
+			continue
+		}
+
+		addrs, err := i.Addrs()
+		if err != nil {
+			continue
+		}
+
+		for _, addr := range addrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+
+			if r := rankIp(ipnet.IP); r > bestRank {
+				best, bestRank = ipnet.IP.String(), r
+			}
+		}
 	}
 
-	defer conn.Close()
+	if best != "" {
+		return best, nil
+	}
 
-	ip, _, err2 := net.SplitHostPort(conn.LocalAddr().String())
-	if err2 != nil {
-		return "", err2
+	if iface != "" {
+		return "", fmt.Errorf("no usable address on interface %s", iface)
 	}
 
-	return ip, nil
+	return "127.0.0.1", nil
+}
+
+// How good an address ip is for the other peers to reach us at; 0 is unusable
+func rankIp(ip net.IP) int {
+	v4 := ip.To4() != nil
+	switch {
+	case ip.IsUnspecified() || ip.IsMulticast() || ip.IsLinkLocalUnicast():
+		return 0
+	case ip.IsLoopback():
+		if v4 {
+			return 1
+		}
+		return 0
+	case !v4:
+		return 2
+	case !ip.IsPrivate():
+		return 3
+	default:
+		return 4
+	}
 }
@@ -0,0 +1,852 @@
+package simnet_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"github.com/tcolgate/mp3"
+	"mob/peer"
+	"mob/proto"
+	"mob/simnet"
+	"mob/trackerd"
+)
+
+const trackerIp = "10.0.0.100"
+const trackerAddr = trackerIp + ":1234"
+
+// A short song cut from one in the repo, so that tests play in seconds
+const testSong = "The-entertainer-piano.mp3"
+const testFrames = 100 // ~2.6s
+
+// One tracker and n peers over net; the first peer has the test song
+type swarm struct {
+	t       *testing.T
+	net     *simnet.Network
+	tracker *trackerd.Tracker
+	peers   []*peer.Peer
+	ips     []string
+	dirs    []string // each peer's songs
+
+	tunePeer func(*peer.Config) // changes the config of peers joined from now on, if not nil
+}
+
+func newSwarm(t *testing.T, net *simnet.Network, n int) *swarm {
+	ips := make([]string, n)
+	for i := range ips {
+		ips[i] = fmt.Sprintf("10.0.0.%d", i+1)
+	}
+
+	return newSwarmAt(t, net, ips)
+}
+
+// A swarm with a peer at each of ips, which may repeat
+func newSwarmAt(t *testing.T, net *simnet.Network, ips []string) *swarm {
+	return newSwarmWith(t, net, ips, nil)
+}
+
+// A swarm whose tracker's config is changed by tune, if not nil
+func newSwarmWith(t *testing.T, net *simnet.Network, ips []string, tune func(*trackerd.Config)) *swarm {
+	ln, err := net.Host(trackerIp).Listen("tcp", trackerAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := trackerd.Config{
+		PeerTimeout:  time.Second,
+		ReadyTimeout: 5 * time.Second,
+		StartDelay:   200 * time.Millisecond,
+		Name:         "test",
+		Logf:         t.Logf,
+	}
+	if tune != nil {
+		tune(&cfg)
+	}
+
+	tracker := trackerd.New(cfg)
+	go tracker.Serve(ln)
+
+	pc, err := net.Host(trackerIp).ListenPacket("udp", fmt.Sprintf(":%d", proto.DiscoveryPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go tracker.Announce(pc)
+
+	s := &swarm{t: t, net: net, tracker: tracker}
+	t.Cleanup(s.close)
+	for i, ip := range ips {
+		dir := t.TempDir()
+		if i == 0 {
+			cutSong(t, filepath.Join("..", "songs", testSong), filepath.Join(dir, testSong), testFrames)
+		}
+
+		s.join(ip, dir)
+	}
+
+	return s
+}
+
+// Start a peer at ip with the songs in dir and join it to the tracker
+func (s *swarm) join(ip string, dir string) *peer.Peer {
+	cfg := peer.DefaultConfig()
+	cfg.Ip = ip
+	cfg.SongsDir = dir
+	cfg.Network = s.net.Host(cfg.Ip)
+	cfg.LeaveDelay = 0
+	cfg.ScanInterval = 50 * time.Millisecond
+	if s.tunePeer != nil {
+		s.tunePeer(&cfg)
+	}
+
+	p := peer.New(cfg)
+	if err := p.Join(trackerAddr); err != nil {
+		s.t.Fatal(err)
+	}
+
+	s.peers = append(s.peers, p)
+	s.ips = append(s.ips, cfg.Ip)
+	s.dirs = append(s.dirs, dir)
+	return p
+}
+
+func (s *swarm) close() {
+	for _, p := range s.peers {
+		p.Leave()
+	}
+
+	s.tracker.Close()
+}
+
+// Is the peer at ip in the tracker's peer list
+func (s *swarm) joined(ip string) bool {
+	for _, info := range s.tracker.Peers() {
+		if strings.HasPrefix(info.Addr, ip+":") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Wait until every peer in want has reported reaching state for song
+func (s *swarm) waitFor(want []*peer.Peer, song string, state peer.SongState, timeout time.Duration) {
+	deadline := time.After(timeout)
+	for i, p := range want {
+		for reached := false; !reached; {
+			select {
+			case e := <-p.Events():
+				reached = e.Type == peer.SongChanged && e.Song.Name == song && e.State == state
+			case <-deadline:
+				st, cur := p.State()
+				s.t.Fatalf("peer %d never got %s %s; it is %s %s", i, state, song, st, cur.Name)
+			}
+		}
+	}
+}
+
+// Wait until the tracker's song list passes ok
+func (s *swarm) waitForSongs(ok func([]proto.Song) bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !ok(s.tracker.Songs()) {
+		if time.Now().After(deadline) {
+			s.t.Fatalf("tracker still has songs %v", s.tracker.Songs())
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func hasName(songs []proto.Song, name string) bool {
+	for _, song := range songs {
+		if song.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// The log, written to by every peer at once
+type syncBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.String()
+}
+
+// Write the first n frames of the mp3 at from to to, with an ID3v2.3 tag
+// holding title and artist in front and an ID3v1 tag holding album behind
+func tagSong(t *testing.T, from string, to string, n int, title string, artist string, album string) {
+	cutSong(t, from, to, n)
+	frames, err := ioutil.ReadFile(to)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var body bytes.Buffer
+	for _, f := range [][2]string{{"TIT2", title}, {"TPE1", artist}} {
+		size := len(f[1]) + 1
+		body.WriteString(f[0])
+		body.Write([]byte{byte(size >> 24), byte(size >> 16), byte(size >> 8), byte(size), 0, 0})
+		body.WriteByte(3) // utf-8
+		body.WriteString(f[1])
+	}
+	body.Write(make([]byte, 64)) // padding
+
+	size := body.Len()
+	var out bytes.Buffer
+	out.Write([]byte{'I', 'D', '3', 3, 0, 0, byte(size >> 21 & 0x7F), byte(size >> 14 & 0x7F), byte(size >> 7 & 0x7F), byte(size & 0x7F)})
+	out.Write(body.Bytes())
+	out.Write(frames)
+
+	v1 := make([]byte, 128)
+	copy(v1, "TAG")
+	copy(v1[63:], album)
+	out.Write(v1)
+
+	if err := ioutil.WriteFile(to, out.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Write the first n frames of the mp3 at from to to
+func cutSong(t *testing.T, from string, to string, n int) {
+	r, err := os.Open(from)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer r.Close()
+
+	var out bytes.Buffer
+	d := mp3.NewDecoder(r)
+	skipped := 0
+	var frame mp3.Frame
+	for i := 0; i < n; i++ {
+		if err := d.Decode(&frame, &skipped); err != nil {
+			t.Fatal(err)
+		}
+
+		b, _ := ioutil.ReadAll(frame.Reader())
+		out.Write(b)
+	}
+
+	if err := ioutil.WriteFile(to, out.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSongReachesEveryPeer(t *testing.T) {
+	s := newSwarm(t, simnet.New(simnet.Link{Latency: 5 * time.Millisecond}, 1), 3)
+
+	if _, err := s.peers[1].Enqueue(testSong); err != nil {
+		t.Fatal(err)
+	}
+
+	s.waitFor(s.peers, testSong, peer.Playing, 10*time.Second)
+	if ph := s.tracker.Phase(); ph != trackerd.Playing && ph != trackerd.Draining {
+		t.Errorf("tracker is %s while peers play", ph)
+	}
+
+	s.waitFor(s.peers, testSong, peer.Done, 10*time.Second)
+	time.Sleep(100 * time.Millisecond)
+	if ph := s.tracker.Phase(); ph != trackerd.Idle {
+		t.Errorf("tracker is %s after the song, want idle", ph)
+	}
+
+	if q := s.tracker.Queue(); len(q) != 0 {
+		t.Errorf("queue is %v after the song, want empty", q)
+	}
+}
+
+func TestSongSurvivesLossAndReordering(t *testing.T) {
+	link := simnet.Link{
+		Latency:      10 * time.Millisecond,
+		Jitter:       5 * time.Millisecond,
+		Loss:         0.05,
+		Reorder:      0.05,
+		ReorderDelay: 20 * time.Millisecond,
+	}
+	s := newSwarm(t, simnet.New(link, 2), 3)
+
+	s.peers[0].Enqueue(testSong)
+	s.waitFor(s.peers, testSong, peer.Done, 20*time.Second)
+}
+
+func TestFECRebuildsLostFrames(t *testing.T) {
+	logs := &syncBuffer{}
+	log.SetOutput(logs)
+	defer log.SetOutput(os.Stderr)
+
+	// Parity is all the peers have to go on; nobody NACKs
+	s := newSwarmAt(t, simnet.New(simnet.Link{Latency: 10 * time.Millisecond, Loss: 0.05}, 16), nil)
+	s.tunePeer = func(cfg *peer.Config) {
+		cfg.FEC = 4
+		cfg.Nacks = false
+	}
+	for i := 1; i <= 3; i++ {
+		dir := t.TempDir()
+		if i == 1 {
+			cutSong(t, filepath.Join("..", "songs", testSong), filepath.Join(dir, testSong), testFrames)
+		}
+		s.join(fmt.Sprintf("10.0.0.%d", i), dir)
+	}
+
+	s.peers[0].Enqueue(testSong)
+	s.waitFor(s.peers, testSong, peer.Done, 20*time.Second)
+
+	if !regexp.MustCompile(`fec: recovered [1-9]`).MatchString(logs.String()) {
+		t.Errorf("no frames rebuilt from parity; log:\n%s", logs)
+	}
+}
+
+func TestSmallBufferStillPlays(t *testing.T) {
+	// The buffer fills up long before the usual prebuffer does, and the
+	// song is longer than the buffer, so writers block until playback
+	s := newSwarmAt(t, simnet.New(simnet.Link{Latency: 5 * time.Millisecond}, 17), nil)
+	s.tunePeer = func(cfg *peer.Config) { cfg.BufferFrames = 50 }
+	for i := 1; i <= 2; i++ {
+		dir := t.TempDir()
+		if i == 1 {
+			cutSong(t, filepath.Join("..", "songs", testSong), filepath.Join(dir, testSong), 150)
+		}
+		s.join(fmt.Sprintf("10.0.0.%d", i), dir)
+	}
+
+	s.peers[0].Enqueue(testSong)
+	s.waitFor(s.peers, testSong, peer.Playing, 3*time.Second) // well before the ready timeout
+	s.waitFor(s.peers, testSong, peer.Done, 10*time.Second)
+}
+
+func TestPeersShareAHost(t *testing.T) {
+	ips := []string{"10.0.0.1", "10.0.0.2", "10.0.0.2", "10.0.0.2"}
+	s := newSwarmAt(t, simnet.New(simnet.Link{Latency: 5 * time.Millisecond}, 5), ips)
+
+	s.peers[2].Enqueue(testSong)
+	s.waitFor(s.peers, testSong, peer.Done, 10*time.Second)
+}
+
+func TestPeersUseTheirAdvertisedPorts(t *testing.T) {
+	s := newSwarmAt(t, simnet.New(simnet.Link{Latency: 5 * time.Millisecond}, 19), nil)
+	s.tunePeer = func(cfg *peer.Config) {
+		cfg.HandshakePort = 6121
+		cfg.MediaPort = 6122
+	}
+	for i := 1; i <= 3; i++ {
+		dir := t.TempDir()
+		if i == 1 {
+			cutSong(t, filepath.Join("..", "songs", testSong), filepath.Join(dir, testSong), testFrames)
+		}
+		s.join(fmt.Sprintf("10.0.0.%d", i), dir)
+	}
+
+	for _, info := range s.tracker.Peers() {
+		if info.HandshakePort != 6121 || info.MediaPort != 6122 {
+			t.Errorf("%s advertised ports %d and %d", info.Addr, info.HandshakePort, info.MediaPort)
+		}
+	}
+
+	s.peers[0].Enqueue(testSong)
+	s.waitFor(s.peers, testSong, peer.Done, 10*time.Second)
+}
+
+func TestSongsAreAnnouncedLive(t *testing.T) {
+	s := newSwarm(t, simnet.New(simnet.Link{Latency: 5 * time.Millisecond}, 7), 2)
+
+	// The second peer gets a song after joining, and plays it for everyone
+	path := filepath.Join(s.dirs[1], "copied.mp3")
+	cutSong(t, filepath.Join("..", "songs", testSong), path, testFrames)
+	s.waitForSongs(func(songs []proto.Song) bool { return hasName(songs, "copied.mp3") })
+
+	s.peers[0].Enqueue("copied.mp3")
+	s.waitFor(s.peers, "copied.mp3", peer.Done, 10*time.Second)
+
+	os.Remove(path)
+	s.waitForSongs(func(songs []proto.Song) bool { return !hasName(songs, "copied.mp3") })
+}
+
+func TestSongsAreKnownByTheirAudio(t *testing.T) {
+	s := newSwarm(t, simnet.New(simnet.Link{Latency: 5 * time.Millisecond}, 8), 3)
+
+	// The first peer's song under another name, and other audio under its name
+	from := filepath.Join("..", "songs", testSong)
+	cutSong(t, from, filepath.Join(s.dirs[1], "renamed.mp3"), testFrames)
+	cutSong(t, from, filepath.Join(s.dirs[2], testSong), testFrames-20)
+	s.waitForSongs(func(songs []proto.Song) bool { return len(songs) == 2 })
+
+	if _, err := s.peers[0].Enqueue(testSong); err == nil {
+		t.Errorf("enqueued %s, which is two songs", testSong)
+	}
+
+	song, err := s.peers[0].Enqueue("renamed.mp3")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Both copies are the same song; it can be picked by its hash too
+	other, err := s.peers[0].Enqueue(song.ShortHash())
+	if err != nil || other.Hash != song.Hash {
+		t.Errorf("enqueued %v, %v by hash; want %v", other, err, song)
+	}
+
+	s.waitFor(s.peers, "renamed.mp3", peer.Done, 10*time.Second)
+}
+
+func TestCopiesOfASongKeepOneName(t *testing.T) {
+	s := newSwarm(t, simnet.New(simnet.Link{Latency: 5 * time.Millisecond}, 18), 2)
+
+	// A second copy sorts after the first, so the song keeps the first's name
+	cutSong(t, filepath.Join("..", "songs", testSong), filepath.Join(s.dirs[0], "copy.mp3"), testFrames)
+	time.Sleep(200 * time.Millisecond) // a few scans to notice it
+
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if songs := s.tracker.Songs(); len(songs) != 1 || songs[0].Name != testSong {
+			t.Fatalf("tracker has songs %v, want just %s", songs, testSong)
+		}
+	}
+}
+
+func TestTagsReachTheCatalog(t *testing.T) {
+	s := newSwarm(t, simnet.New(simnet.Link{Latency: 5 * time.Millisecond}, 9), 3)
+
+	// Tags don't make the first peer's song another song; they do describe it
+	from := filepath.Join("..", "songs", testSong)
+	tagSong(t, from, filepath.Join(s.dirs[1], "tagged.mp3"), testFrames, "The Entertainer", "Scott Joplin", "Rags")
+	tagSong(t, from, filepath.Join(s.dirs[2], "short.mp3"), 80, "Intro", "Scott Joplin", "Rags")
+	s.waitForSongs(func(songs []proto.Song) bool { return len(songs) == 2 })
+
+	for _, song := range s.tracker.Songs() {
+		if song.Name != "short.mp3" {
+			continue
+		}
+
+		if song.Title != "Intro" || song.Artist != "Scott Joplin" || song.Album != "Rags" {
+			t.Errorf("got tags %q, %q, %q", song.Title, song.Artist, song.Album)
+		}
+
+		// 80 frames of 1152 samples at 44.1kHz, 192kbps
+		if song.Duration < 2*time.Second || song.Duration > 2100*time.Millisecond || song.Bitrate != 192 || song.SampleRate != 44100 {
+			t.Errorf("got %v at %d kbps, %d Hz", song.Duration, song.Bitrate, song.SampleRate)
+		}
+	}
+}
+
+func TestSearchFindsSongs(t *testing.T) {
+	s := newSwarm(t, simnet.New(simnet.Link{Latency: 5 * time.Millisecond}, 10), 3)
+
+	from := filepath.Join("..", "songs", testSong)
+	tagSong(t, from, filepath.Join(s.dirs[1], "winter.mp3"), 40, "Winter", "Antonio Vivaldi", "The Four Seasons")
+	tagSong(t, from, filepath.Join(s.dirs[2], "intro.mp3"), 80, "Intro", "Scott Joplin", "Rags")
+	s.waitForSongs(func(songs []proto.Song) bool { return len(songs) == 3 })
+
+	for query, want := range map[string][]string{
+		"vivaldi":                      {"winter.mp3"},
+		"ENTERTAINER":                  {testSong},
+		"artist:vivadli":               {"winter.mp3"},
+		`album:"four seasons"`:         {"winter.mp3"},
+		"artist:joplin duration:<2.5s": {"intro.mp3"},
+		"duration:<2.5s bitrate:>=192": {"winter.mp3", "intro.mp3"},
+		"title:intro artist:vivaldi":   nil,
+		"":                             {"intro.mp3", testSong, "winter.mp3"},
+	} {
+		songs, err := s.peers[0].Search(query)
+		if err != nil {
+			t.Errorf("%q: %v", query, err)
+			continue
+		}
+
+		var got []string
+		for _, song := range songs {
+			got = append(got, song.Name)
+		}
+		sort.Strings(got)
+		sort.Strings(want)
+		if strings.Join(got, " ") != strings.Join(want, " ") {
+			t.Errorf("%q found %v, want %v", query, got, want)
+		}
+	}
+
+	if _, err := s.peers[0].Search("lenght:<5m"); err == nil {
+		t.Error("searched an unknown field")
+	}
+}
+
+func TestQueueCanBeRearrangedAndSkipped(t *testing.T) {
+	s := newSwarm(t, simnet.New(simnet.Link{Latency: 5 * time.Millisecond}, 11), 3)
+
+	// ~52s, paced out to the other peers, so it is still playing when skipped
+	cutSong(t, filepath.Join("..", "songs", "Chopin-waltz-in-a-minor.mp3"), filepath.Join(s.dirs[1], "long.mp3"), 2000)
+	cutSong(t, filepath.Join("..", "songs", "Vivaldi-winter.mp3"), filepath.Join(s.dirs[2], "winter.mp3"), 40)
+	s.waitForSongs(func(songs []proto.Song) bool { return len(songs) == 3 })
+
+	s.peers[0].Enqueue("long.mp3")
+	s.waitFor(s.peers, "long.mp3", peer.Playing, 10*time.Second)
+
+	for _, song := range []string{testSong, "winter.mp3", testSong} {
+		if _, err := s.peers[0].Enqueue(song); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	upNext := func(want ...string) {
+		t.Helper()
+		queue, err := s.peers[1].Queue()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got []string
+		for _, song := range queue.Songs {
+			got = append(got, song.Name)
+		}
+		if queue.Current.Name != "long.mp3" || strings.Join(got, " ") != strings.Join(want, " ") {
+			t.Fatalf("queue is %s then %v, want long.mp3 then %v", queue.Current.Name, got, want)
+		}
+	}
+
+	// Only the peer that enqueued a song can move or remove it
+	upNext(testSong, "winter.mp3", testSong)
+	if _, err := s.peers[1].Move(2, 1); err == nil {
+		t.Error("moved another peer's song")
+	}
+	if _, err := s.peers[0].Move(2, 1); err != nil {
+		t.Fatal(err)
+	}
+	upNext("winter.mp3", testSong, testSong)
+	if _, err := s.peers[2].Remove(3); err == nil {
+		t.Error("removed another peer's song")
+	}
+	if _, err := s.peers[0].Remove(3); err != nil {
+		t.Fatal(err)
+	}
+	upNext("winter.mp3", testSong)
+	if _, err := s.peers[0].Remove(3); err == nil {
+		t.Error("removed a song past the end of the queue")
+	}
+
+	// and clear only drops the peer's own songs
+	s.peers[1].Enqueue(testSong)
+	if cleared, err := s.peers[0].Clear(); err != nil || len(cleared) != 2 {
+		t.Fatalf("cleared %v: %v", cleared, err)
+	}
+	upNext(testSong)
+	if cleared, err := s.peers[1].Clear(); err != nil || len(cleared) != 1 {
+		t.Fatalf("cleared %v: %v", cleared, err)
+	}
+	upNext()
+
+	// Skipping drops the song everywhere and moves on to the next one. It
+	// takes two of the three peers' votes; voting twice counts once.
+	s.peers[0].Enqueue("winter.mp3")
+	for _, p := range []*peer.Peer{s.peers[2], s.peers[2]} {
+		if vote, err := p.Skip(); err != nil || vote.Song.Name != "long.mp3" || vote.Votes != 1 || vote.Needed != 2 || vote.Skipped {
+			t.Fatalf("voted to skip: %+v, %v", vote, err)
+		}
+	}
+	if vote, err := s.peers[0].Skip(); err != nil || !vote.Skipped {
+		t.Fatalf("voted to skip: %+v, %v", vote, err)
+	}
+	s.waitFor(s.peers, "long.mp3", peer.Idle, 5*time.Second)
+	s.waitFor(s.peers, "winter.mp3", peer.Done, 10*time.Second)
+
+	if _, err := s.peers[0].Skip(); err == nil {
+		t.Error("skipped while nothing was playing")
+	}
+}
+
+func TestVotesOrderTheQueue(t *testing.T) {
+	s := newSwarm(t, simnet.New(simnet.Link{Latency: 5 * time.Millisecond}, 12), 3)
+
+	from := filepath.Join("..", "songs", testSong)
+	cutSong(t, filepath.Join("..", "songs", "Chopin-waltz-in-a-minor.mp3"), filepath.Join(s.dirs[1], "long.mp3"), 2000)
+	cutSong(t, from, filepath.Join(s.dirs[1], "intro.mp3"), 60)
+	cutSong(t, filepath.Join("..", "songs", "Vivaldi-winter.mp3"), filepath.Join(s.dirs[2], "winter.mp3"), 40)
+	s.waitForSongs(func(songs []proto.Song) bool { return len(songs) == 4 })
+
+	// Keep the queue still while we vote
+	s.peers[0].Enqueue("long.mp3")
+	s.waitFor(s.peers, "long.mp3", peer.Playing, 10*time.Second)
+	for _, song := range []string{testSong, "winter.mp3", "intro.mp3"} {
+		s.peers[0].Enqueue(song)
+	}
+
+	upNext := func(want string) {
+		t.Helper()
+		queue, err := s.peers[1].Queue()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got []string
+		for i, song := range queue.Songs {
+			got = append(got, fmt.Sprintf("%s%+d", song.Name, queue.Scores[i]))
+		}
+		if strings.Join(got, " ") != want {
+			t.Fatalf("queue is %v, want %s", got, want)
+		}
+	}
+
+	vote := func(song proto.Song, err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	upNext(testSong + "+0 winter.mp3+0 intro.mp3+0")
+	vote(s.peers[0].Upvote(3))
+	upNext("intro.mp3+1 " + testSong + "+0 winter.mp3+0")
+	vote(s.peers[1].Downvote(2))
+	upNext("intro.mp3+1 winter.mp3+0 " + testSong + "-1")
+
+	// Equal scores go first come first served
+	vote(s.peers[2].Upvote(3))
+	upNext("intro.mp3+1 " + testSong + "+0 winter.mp3+0")
+
+	// Voting again replaces the vote
+	vote(s.peers[1].Upvote(2))
+	upNext(testSong + "+2 intro.mp3+1 winter.mp3+0")
+
+	if _, err := s.peers[1].Upvote(4); err == nil {
+		t.Error("voted on a song past the end of the queue")
+	}
+
+	// Votes go with the peer
+	s.peers[2].Leave()
+	upNext(testSong + "+1 intro.mp3+1 winter.mp3+0")
+}
+
+func TestFairQueueTakesTurns(t *testing.T) {
+	ips := []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}
+	s := newSwarmWith(t, simnet.New(simnet.Link{Latency: 5 * time.Millisecond}, 13), ips, func(cfg *trackerd.Config) {
+		cfg.FairQueue = true
+		cfg.MaxQueued = 2
+	})
+
+	// Both long enough to still be playing while we look at the queue
+	cutSong(t, filepath.Join("..", "songs", "Chopin-waltz-in-a-minor.mp3"), filepath.Join(s.dirs[1], "long.mp3"), 2000)
+	cutSong(t, filepath.Join("..", "songs", testSong), filepath.Join(s.dirs[1], "intro.mp3"), 60)
+	cutSong(t, filepath.Join("..", "songs", "Vivaldi-winter.mp3"), filepath.Join(s.dirs[2], "winter.mp3"), 2000)
+	s.waitForSongs(func(songs []proto.Song) bool { return len(songs) == 4 })
+
+	s.peers[0].Enqueue("long.mp3")
+	s.waitFor(s.peers, "long.mp3", peer.Playing, 10*time.Second)
+
+	enqueue := func(p *peer.Peer, songs ...string) {
+		t.Helper()
+		for _, song := range songs {
+			if _, err := p.Enqueue(song); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// Songs up next as name@peer
+	upNext := func(current string, want string) {
+		t.Helper()
+		queue, err := s.peers[1].Queue()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got []string
+		for i, song := range queue.Songs {
+			for j, p := range s.peers {
+				if queue.Owners[i] == p.Id() {
+					got = append(got, fmt.Sprintf("%s@%d", song.Name, j))
+				}
+			}
+		}
+		if queue.Current.Name != current || strings.Join(got, " ") != want {
+			t.Fatalf("queue is %s then %v, want %s then %s", queue.Current.Name, got, current, want)
+		}
+	}
+
+	enqueue(s.peers[0], testSong, "intro.mp3")
+	if _, err := s.peers[0].Enqueue("winter.mp3"); err == nil {
+		t.Error("enqueued past the limit")
+	}
+	enqueue(s.peers[1], "winter.mp3", testSong)
+	enqueue(s.peers[2], "intro.mp3")
+
+	// Peer 0 just had its turn, so it goes last in every round
+	upNext("long.mp3", "winter.mp3@1 intro.mp3@2 "+testSong+"@0 "+testSong+"@1 intro.mp3@0")
+
+	// Votes order a peer's own songs
+	if _, err := s.peers[2].Upvote(5); err != nil {
+		t.Fatal(err)
+	}
+	upNext("long.mp3", "winter.mp3@1 intro.mp3@2 intro.mp3@0 "+testSong+"@1 "+testSong+"@0")
+
+	// Then it's peer 1's turn, and then it goes last
+	s.peers[0].Skip()
+	if vote, err := s.peers[1].Skip(); err != nil || !vote.Skipped {
+		t.Fatalf("voted to skip: %+v, %v", vote, err)
+	}
+	s.waitFor(s.peers, "winter.mp3", peer.Playing, 10*time.Second)
+	upNext("winter.mp3", "intro.mp3@2 intro.mp3@0 "+testSong+"@1 "+testSong+"@0")
+
+	// The current song doesn't count towards the limit
+	enqueue(s.peers[1], "long.mp3")
+	upNext("winter.mp3", "intro.mp3@2 intro.mp3@0 "+testSong+"@1 "+testSong+"@0 long.mp3@1")
+
+	// Rejoining doesn't get a peer a fresh turn or a fresh limit, and its
+	// songs stay its own
+	s.peers[0].Leave()
+	if err := s.peers[0].Join(trackerAddr); err != nil {
+		t.Fatal(err)
+	}
+	upNext("winter.mp3", "intro.mp3@2 intro.mp3@0 "+testSong+"@1 "+testSong+"@0 long.mp3@1")
+	if _, err := s.peers[0].Enqueue("winter.mp3"); err == nil {
+		t.Error("enqueued past the limit after rejoining")
+	}
+	if _, err := s.peers[0].Remove(4); err != nil {
+		t.Fatal(err)
+	}
+	upNext("winter.mp3", "intro.mp3@2 intro.mp3@0 "+testSong+"@1 long.mp3@1")
+}
+
+func TestLateJoinerDoesntHoldUpTheNextSong(t *testing.T) {
+	s := newSwarm(t, simnet.New(simnet.Link{Latency: 5 * time.Millisecond}, 14), 2)
+
+	// Longer than the burst, so it is still streaming when the peer joins
+	cutSong(t, filepath.Join("..", "songs", "Chopin-waltz-in-a-minor.mp3"), filepath.Join(s.dirs[0], "long.mp3"), 600)
+	cutSong(t, filepath.Join("..", "songs", "Vivaldi-winter.mp3"), filepath.Join(s.dirs[1], "winter.mp3"), 40)
+	s.waitForSongs(func(songs []proto.Song) bool { return len(songs) == 3 })
+
+	s.peers[0].Enqueue("long.mp3")
+	s.waitFor(s.peers, "long.mp3", peer.Playing, 10*time.Second)
+
+	// Nobody streams to it; it waits on long.mp3 until the tracker moves on
+	late := s.join("10.0.0.3", t.TempDir())
+	s.waitFor([]*peer.Peer{late}, "long.mp3", peer.Receiving, 5*time.Second)
+
+	s.peers[1].Enqueue("winter.mp3")
+	s.waitFor(s.peers[:2], "winter.mp3", peer.Done, 20*time.Second)
+}
+
+func TestPeersDiscoverTheTracker(t *testing.T) {
+	s := newSwarm(t, simnet.New(simnet.Link{Latency: 5 * time.Millisecond}, 6), 2)
+
+	found, err := s.peers[0].Discover(200 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := peer.TrackerInfo{"test", trackerAddr, 2}
+	if len(found) != 1 || found[0] != want {
+		t.Fatalf("discovered %v, want [%v]", found, want)
+	}
+
+	// Nothing answers across a partition
+	s.net.Partition(s.ips[1], trackerIp)
+	if found, _ := s.peers[1].Discover(200 * time.Millisecond); len(found) != 0 {
+		t.Errorf("discovered %v across a partition", found)
+	}
+}
+
+func TestPartitionedPeerIsEvicted(t *testing.T) {
+	s := newSwarm(t, simnet.New(simnet.Link{Latency: 5 * time.Millisecond}, 3), 3)
+
+	s.peers[0].Enqueue(testSong)
+	s.waitFor(s.peers, testSong, peer.Playing, 10*time.Second)
+
+	// Cut the last peer (a leaf of the stream graph) off from everyone
+	lost := s.ips[2]
+	s.net.Partition(lost, trackerIp)
+	for _, ip := range s.ips[:2] {
+		s.net.Partition(lost, ip)
+	}
+
+	// The others finish, and the tracker moves on once it gives up on it
+	s.waitFor(s.peers[:2], testSong, peer.Done, 10*time.Second)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for s.joined(lost) || s.tracker.Phase() != trackerd.Idle {
+		if time.Now().After(deadline) {
+			t.Fatalf("tracker is %s with peers %v; want the partitioned one evicted", s.tracker.Phase(), s.tracker.Peers())
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestSongIsSkippedWhenItsSeederIsEvicted(t *testing.T) {
+	s := newSwarm(t, simnet.New(simnet.Link{Latency: 5 * time.Millisecond}, 15), 3)
+
+	cutSong(t, filepath.Join("..", "songs", "Chopin-waltz-in-a-minor.mp3"), filepath.Join(s.dirs[0], "long.mp3"), 600)
+	cutSong(t, filepath.Join("..", "songs", "Vivaldi-winter.mp3"), filepath.Join(s.dirs[1], "winter.mp3"), 40)
+	s.waitForSongs(func(songs []proto.Song) bool { return len(songs) == 3 })
+
+	// None of long.mp3 gets through; the others wait on it until the
+	// tracker gives up on the only peer that has it
+	for _, ip := range s.ips[1:] {
+		s.net.Partition(s.ips[0], ip)
+	}
+	s.peers[1].Enqueue("long.mp3")
+	s.peers[1].Enqueue("winter.mp3")
+	s.waitFor(s.peers[1:], "long.mp3", peer.Receiving, 5*time.Second)
+
+	s.net.Partition(s.ips[0], trackerIp)
+	s.waitFor(s.peers[1:], "long.mp3", peer.Idle, 10*time.Second)
+	s.waitFor(s.peers[1:], "winter.mp3", peer.Done, 10*time.Second)
+}
+
+func TestPacketsFollowTheLink(t *testing.T) {
+	n := simnet.New(simnet.Link{Latency: 20 * time.Millisecond}, 4)
+	a, err := n.Host("10.0.0.1").ListenPacket("udp", ":6121")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	b, err := n.Host("10.0.0.2").Dial("udp", "10.0.0.1:6121")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	start := time.Now()
+	b.Write([]byte("request"))
+
+	buf := make([]byte, 16)
+	k, from, err := a.ReadFrom(buf)
+	if err != nil || string(buf[:k]) != "request" {
+		t.Fatalf("got %q, %v", buf[:k], err)
+	}
+
+	if d := time.Since(start); d < 20*time.Millisecond {
+		t.Errorf("packet took %v, want at least the link's 20ms", d)
+	}
+
+	// Replies reach the dialed socket
+	a.WriteTo([]byte("accept"), from)
+	k, _ = b.Read(buf)
+	if string(buf[:k]) != "accept" {
+		t.Errorf("got %q back, want accept", buf[:k])
+	}
+
+	// Nothing crosses a partition, and reads time out
+	n.Partition("10.0.0.1", "10.0.0.2")
+	b.Write([]byte("request"))
+	a.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, _, err := a.ReadFrom(buf); err == nil {
+		t.Error("packet crossed a partition")
+	}
+}
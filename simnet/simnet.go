@@ -0,0 +1,570 @@
+// Package simnet is an in-memory network for running a tracker and any
+// number of peers in one process, as in tests.
+//
+// Packets (udp) see the configured latency, jitter, loss and reordering and
+// are dropped between partitioned hosts; packets to 255.255.255.255 reach
+// every host listening on the port. Streams (tcp) are reliable and
+// instant, but stall while their two ends are partitioned, like a tcp
+// connection would. Which packets get lost or held back is drawn from a
+// seeded source, but packets are delivered on real timers and every host
+// draws from the one source, so what a run loses depends on how its
+// goroutines happen to be scheduled. Runs aren't repeatable, and take as
+// long as the delays they simulate.
+package simnet
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// How a packet travels between two hosts
+type Link struct {
+	Latency      time.Duration // one way delay of every packet
+	Jitter       time.Duration // up to this much extra delay, at random
+	Loss         float64       // chance a packet is dropped
+	Reorder      float64       // chance a packet is held back by ReorderDelay
+	ReorderDelay time.Duration
+}
+
+// Packets a socket holds before it drops new ones, like a socket buffer
+const inboxLen = 1024
+
+// First port handed out to sockets bound to port 0
+const firstEphemeralPort = 40000
+
+var errRefused = errors.New("connection refused")
+var errUnreachable = errors.New("network is unreachable")
+var errInUse = errors.New("address already in use")
+var errNotLocal = errors.New("cannot assign requested address")
+
+type Network struct {
+	mu         sync.Mutex
+	link       Link
+	rand       *rand.Rand
+	packets    map[string]*packetConn // by ip:port
+	listeners  map[string]*listener   // by ip:port
+	cuts       map[[2]string]bool     // partitioned host pairs
+	ports      map[string]int         // next ephemeral port of each host
+	streamCond *sync.Cond             // woken when partitions change
+}
+
+// A network whose packets travel over link, losing and reordering them at
+// random from seed
+func New(link Link, seed int64) *Network {
+	n := &Network{
+		link:      link,
+		rand:      rand.New(rand.NewSource(seed)),
+		packets:   make(map[string]*packetConn),
+		listeners: make(map[string]*listener),
+		cuts:      make(map[[2]string]bool),
+		ports:     make(map[string]int),
+	}
+
+	n.streamCond = sync.NewCond(&n.mu)
+	return n
+}
+
+// Change how packets travel from now on
+func (n *Network) SetLink(link Link) {
+	n.mu.Lock()
+	n.link = link
+	n.mu.Unlock()
+}
+
+// Cut hosts a and b off from each other
+func (n *Network) Partition(a, b string) {
+	n.mu.Lock()
+	n.cuts[pair(a, b)] = true
+	n.mu.Unlock()
+}
+
+// Undo Partition
+func (n *Network) Heal(a, b string) {
+	n.mu.Lock()
+	delete(n.cuts, pair(a, b))
+	n.streamCond.Broadcast()
+	n.mu.Unlock()
+}
+
+// The network as seen from the host with the given ip. It satisfies
+// peer.Network.
+func (n *Network) Host(ip string) *Host {
+	return &Host{n, ip}
+}
+
+func pair(a, b string) [2]string {
+	if a > b {
+		a, b = b, a
+	}
+
+	return [2]string{a, b}
+}
+
+// Must hold mu
+func (n *Network) cut(a, b string) bool {
+	return n.cuts[pair(a, b)]
+}
+
+// Must hold mu
+func (n *Network) ephemeral(ip string, taken func(string) bool) string {
+	for {
+		port, ok := n.ports[ip]
+		if !ok {
+			port = firstEphemeralPort
+		}
+		n.ports[ip] = port + 1
+
+		addr := net.JoinHostPort(ip, strconv.Itoa(port))
+		if !taken(addr) {
+			return addr
+		}
+	}
+}
+
+// Send a packet, or don't, as the link decides
+func (n *Network) send(from *net.UDPAddr, to string, b []byte) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for _, dst := range n.destinations(to) {
+		if !n.cut(from.IP.String(), dst.addr.IP.String()) {
+			n.deliver(from, dst, b)
+		}
+	}
+}
+
+// Sockets a packet sent to to reaches: the one bound there, or for the
+// broadcast address every unconnected socket bound to its port. Must hold mu.
+func (n *Network) destinations(to string) []*packetConn {
+	host, port, err := net.SplitHostPort(to)
+	if err != nil {
+		return nil
+	}
+
+	if host != net.IPv4bcast.String() {
+		if dst, ok := n.packets[to]; ok {
+			return []*packetConn{dst}
+		}
+		return nil
+	}
+
+	var dsts []*packetConn
+	for _, c := range n.packets {
+		if strconv.Itoa(c.addr.Port) == port && c.remote == nil {
+			dsts = append(dsts, c)
+		}
+	}
+
+	// in a fixed order, so runs stay reproducible
+	sort.Slice(dsts, func(i, j int) bool { return dsts[i].addr.String() < dsts[j].addr.String() })
+	return dsts
+}
+
+// Hand one packet to dst after the link's delay. Must hold mu.
+func (n *Network) deliver(from *net.UDPAddr, dst *packetConn, b []byte) {
+	if n.link.Loss > 0 && n.rand.Float64() < n.link.Loss {
+		return
+	}
+
+	delay := n.link.Latency
+	if n.link.Jitter > 0 {
+		delay += time.Duration(n.rand.Int63n(int64(n.link.Jitter)))
+	}
+	if n.link.Reorder > 0 && n.rand.Float64() < n.link.Reorder {
+		delay += n.link.ReorderDelay
+	}
+
+	p := packet{append([]byte(nil), b...), from}
+	if delay <= 0 {
+		dst.deliver(p)
+		return
+	}
+
+	time.AfterFunc(delay, func() { dst.deliver(p) })
+}
+
+// One host's view of a Network
+type Host struct {
+	n  *Network
+	ip string
+}
+
+func (h *Host) Ip() string {
+	return h.ip
+}
+
+// Open a udp socket, or a tcp connection to a Listen-ing host
+func (h *Host) Dial(network, address string) (net.Conn, error) {
+	switch network {
+	case "udp", "udp4":
+		remote, err := net.ResolveUDPAddr("udp", address)
+		if err != nil {
+			return nil, err
+		}
+
+		pc, err := h.listenPacket(network, "")
+		if err != nil {
+			return nil, err
+		}
+
+		pc.remote = remote
+		return pc, nil
+	case "tcp", "tcp4":
+		return h.dialStream(network, address)
+	}
+
+	return nil, &net.OpError{Op: "dial", Net: network, Err: net.UnknownNetworkError(network)}
+}
+
+// Open a udp socket at address; an empty host or port 0 pick for us
+func (h *Host) ListenPacket(network, address string) (net.PacketConn, error) {
+	if network != "udp" && network != "udp4" {
+		return nil, &net.OpError{Op: "listen", Net: network, Err: net.UnknownNetworkError(network)}
+	}
+
+	return h.listenPacket(network, address)
+}
+
+// Accept tcp connections at address
+func (h *Host) Listen(network, address string) (net.Listener, error) {
+	if network != "tcp" && network != "tcp4" {
+		return nil, &net.OpError{Op: "listen", Net: network, Err: net.UnknownNetworkError(network)}
+	}
+
+	n := h.n
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	addr, err := h.bind(address, func(a string) bool { return n.listeners[a] != nil })
+	if err != nil {
+		return nil, &net.OpError{Op: "listen", Net: network, Err: err}
+	}
+
+	tcpAddr, _ := net.ResolveTCPAddr("tcp", addr)
+	l := &listener{n: n, addr: tcpAddr, accept: make(chan net.Conn, 16), closed: make(chan struct{})}
+	n.listeners[addr] = l
+	return l, nil
+}
+
+func (h *Host) listenPacket(network, address string) (*packetConn, error) {
+	n := h.n
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	addr, err := h.bind(address, func(a string) bool { return n.packets[a] != nil })
+	if err != nil {
+		return nil, &net.OpError{Op: "listen", Net: network, Err: err}
+	}
+
+	udpAddr, _ := net.ResolveUDPAddr("udp", addr)
+	pc := &packetConn{
+		n:      n,
+		addr:   udpAddr,
+		inbox:  make(chan packet, inboxLen),
+		closed: make(chan struct{}),
+	}
+
+	n.packets[addr] = pc
+	return pc, nil
+}
+
+// Work out which ip:port of ours address means. Must hold mu.
+func (h *Host) bind(address string, taken func(string) bool) (string, error) {
+	ip, port := "", "0"
+	if address != "" {
+		var err error
+		if ip, port, err = net.SplitHostPort(address); err != nil {
+			return "", err
+		}
+	}
+
+	if ip != "" && ip != h.ip && ip != "0.0.0.0" {
+		return "", errNotLocal
+	}
+
+	if port == "0" {
+		return h.n.ephemeral(h.ip, taken), nil
+	}
+
+	addr := net.JoinHostPort(h.ip, port)
+	if taken(addr) {
+		return "", errInUse
+	}
+
+	return addr, nil
+}
+
+func (h *Host) dialStream(network, address string) (net.Conn, error) {
+	n := h.n
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	l, ok := n.listeners[address]
+	if !ok {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: errRefused}
+	}
+
+	if n.cut(h.ip, l.addr.IP.String()) {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: errUnreachable}
+	}
+
+	local, _ := net.ResolveTCPAddr("tcp", n.ephemeral(h.ip, func(string) bool { return false }))
+	ab, ba := &pipe{}, &pipe{}
+	client := &streamConn{n: n, local: local, remote: l.addr, rx: ba, tx: ab}
+	server := &streamConn{n: n, local: l.addr, remote: local, rx: ab, tx: ba}
+
+	select {
+	case l.accept <- server:
+		return client, nil
+	case <-l.closed:
+		return nil, &net.OpError{Op: "dial", Net: network, Err: errRefused}
+	default:
+		return nil, &net.OpError{Op: "dial", Net: network, Err: errRefused} // backlog full
+	}
+}
+
+type packet struct {
+	b    []byte
+	from *net.UDPAddr
+}
+
+// A udp socket. Dialed ones have a remote and only talk to it.
+type packetConn struct {
+	n      *Network
+	addr   *net.UDPAddr
+	remote *net.UDPAddr
+	inbox  chan packet
+	closed chan struct{}
+	once   sync.Once
+
+	mu       sync.Mutex
+	deadline time.Time
+}
+
+func (c *packetConn) deliver(p packet) {
+	select {
+	case <-c.closed:
+	case c.inbox <- p:
+	default: // socket buffer full
+	}
+}
+
+func (c *packetConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.mu.Lock()
+	deadline := c.deadline
+	c.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return 0, nil, c.opError("read", os.ErrDeadlineExceeded)
+		}
+
+		t := time.NewTimer(d)
+		defer t.Stop()
+		timeout = t.C
+	}
+
+	for {
+		select {
+		case p := <-c.inbox:
+			if c.remote != nil && p.from.String() != c.remote.String() {
+				continue // connected sockets only hear from their remote
+			}
+			return copy(b, p.b), p.from, nil
+		case <-c.closed:
+			return 0, nil, c.opError("read", net.ErrClosed)
+		case <-timeout:
+			return 0, nil, c.opError("read", os.ErrDeadlineExceeded)
+		}
+	}
+}
+
+func (c *packetConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, c.opError("write", net.ErrClosed)
+	default:
+	}
+
+	c.n.send(c.addr, addr.String(), b)
+	return len(b), nil
+}
+
+func (c *packetConn) Read(b []byte) (int, error) {
+	n, _, err := c.ReadFrom(b)
+	return n, err
+}
+
+func (c *packetConn) Write(b []byte) (int, error) {
+	if c.remote == nil {
+		return 0, c.opError("write", errors.New("destination address required"))
+	}
+
+	return c.WriteTo(b, c.remote)
+}
+
+func (c *packetConn) Close() error {
+	closed := false
+	c.once.Do(func() {
+		close(c.closed)
+		c.n.mu.Lock()
+		delete(c.n.packets, c.addr.String())
+		c.n.mu.Unlock()
+		closed = true
+	})
+
+	if !closed {
+		return c.opError("close", net.ErrClosed)
+	}
+
+	return nil
+}
+
+func (c *packetConn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+func (c *packetConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *packetConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *packetConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	return nil
+}
+
+// Writes never block
+func (c *packetConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *packetConn) opError(op string, err error) error {
+	return &net.OpError{Op: op, Net: "udp", Source: c.addr, Addr: c.remote, Err: err}
+}
+
+type listener struct {
+	n      *Network
+	addr   *net.TCPAddr
+	accept chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.accept:
+		return c, nil
+	case <-l.closed:
+		return nil, &net.OpError{Op: "accept", Net: "tcp", Addr: l.addr, Err: net.ErrClosed}
+	}
+}
+
+func (l *listener) Close() error {
+	l.once.Do(func() {
+		close(l.closed)
+		l.n.mu.Lock()
+		delete(l.n.listeners, l.addr.String())
+		l.n.mu.Unlock()
+	})
+
+	return nil
+}
+
+func (l *listener) Addr() net.Addr {
+	return l.addr
+}
+
+// One direction of a stream. Guarded by the network's mutex so partitions
+// can wake up readers.
+type pipe struct {
+	buf    bytes.Buffer
+	closed bool
+}
+
+type streamConn struct {
+	n      *Network
+	local  *net.TCPAddr
+	remote *net.TCPAddr
+	rx, tx *pipe
+}
+
+// Blocks until there is data we can see past any partition
+func (c *streamConn) Read(b []byte) (int, error) {
+	n := c.n
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for !c.rx.closed && (c.rx.buf.Len() == 0 || n.cut(c.local.IP.String(), c.remote.IP.String())) {
+		n.streamCond.Wait()
+	}
+
+	if c.rx.buf.Len() == 0 {
+		return 0, io.EOF
+	}
+
+	return c.rx.buf.Read(b)
+}
+
+func (c *streamConn) Write(b []byte) (int, error) {
+	n := c.n
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if c.tx.closed {
+		return 0, &net.OpError{Op: "write", Net: "tcp", Source: c.local, Addr: c.remote, Err: net.ErrClosed}
+	}
+
+	c.tx.buf.Write(b)
+	n.streamCond.Broadcast()
+	return len(b), nil
+}
+
+// Hangs up both directions; the other end reads what's left, then EOF
+func (c *streamConn) Close() error {
+	n := c.n
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	c.tx.closed = true
+	c.rx.closed = true
+	c.rx.buf.Reset()
+	n.streamCond.Broadcast()
+	return nil
+}
+
+func (c *streamConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *streamConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// Deadlines aren't supported on streams; nothing in mob uses them
+func (c *streamConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *streamConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *streamConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,294 @@
+package trackerd
+
+import (
+	"fmt"
+	"mob/proto"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Catalog search.
+//
+// A query is a list of terms, all of which a song has to match. A bare term
+// matches the song's title, artist, album or file name; a qualified one
+// (artist:vivaldi) only that field. Text matches as a case-insensitive
+// substring or, failing that, fuzzily: some words of the field are within a
+// typo per 4 letters of the term. hash: matches a prefix of the hash, and
+// duration: and bitrate: (in kbps) compare numbers, i.e. duration:<5m or
+// bitrate:>=192. Double quotes keep spaces in a term: artist:"scott joplin".
+
+// How well a song matches a term
+const (
+	noMatch = iota
+	fuzzyMatch
+	exactMatch
+)
+
+var textFields = map[string]func(proto.Song) string{
+	"title":  func(s proto.Song) string { return s.Title },
+	"artist": func(s proto.Song) string { return s.Artist },
+	"album":  func(s proto.Song) string { return s.Album },
+	"name":   func(s proto.Song) string { return s.Name },
+	"file":   func(s proto.Song) string { return s.Name },
+}
+
+type term struct {
+	field string // "" matches any text field
+	text  string // lowercased
+	op    string // <, <=, >, >= or = for duration and bitrate
+	num   int64  // nanoseconds or kbps
+}
+
+// The songs matching query, best matches first. An empty query matches
+// every song.
+func search(songs []proto.Song, query string) ([]proto.Song, error) {
+	terms, err := parseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	var found []proto.Song
+	scores := make(map[string]int)
+	for _, song := range songs {
+		score := 0
+		for _, t := range terms {
+			m := t.match(song)
+			if m == noMatch {
+				score = -1
+				break
+			}
+			score += m
+		}
+
+		if score >= 0 {
+			found = append(found, song)
+			scores[song.Hash] = score
+		}
+	}
+
+	sort.SliceStable(found, func(i, j int) bool { return scores[found[i].Hash] > scores[found[j].Hash] })
+	return found, nil
+}
+
+func parseQuery(query string) ([]term, error) {
+	var terms []term
+	for _, word := range splitQuery(query) {
+		t, err := parseTerm(word)
+		if err != nil {
+			return nil, err
+		}
+		terms = append(terms, t)
+	}
+
+	return terms, nil
+}
+
+// Split query on spaces outside double quotes, dropping the quotes
+func splitQuery(query string) []string {
+	var words []string
+	var b strings.Builder
+	quoted := false
+	for _, r := range query {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case unicode.IsSpace(r) && !quoted:
+			if b.Len() > 0 {
+				words = append(words, b.String())
+				b.Reset()
+			}
+		default:
+			b.WriteRune(r)
+		}
+	}
+
+	if b.Len() > 0 {
+		words = append(words, b.String())
+	}
+
+	return words
+}
+
+func parseTerm(word string) (term, error) {
+	i := strings.Index(word, ":")
+	if i <= 0 || strings.IndexFunc(word[:i], func(r rune) bool { return !unicode.IsLetter(r) }) >= 0 {
+		return term{text: strings.ToLower(word)}, nil
+	}
+
+	field, value := strings.ToLower(word[:i]), word[i+1:]
+	t := term{field: field, text: strings.ToLower(value)}
+	switch field {
+	case "hash":
+	case "duration":
+		op, v := parseOp(value)
+		d, err := parseDuration(v)
+		if err != nil {
+			return t, fmt.Errorf("%w: %s is not a duration, i.e. 5m or 3:30", ErrBadQuery, v)
+		}
+		t.op, t.num = op, int64(d)
+	case "bitrate":
+		op, v := parseOp(value)
+		kbps, err := strconv.Atoi(strings.TrimSuffix(strings.ToLower(v), "kbps"))
+		if err != nil {
+			return t, fmt.Errorf("%w: %s is not a bitrate in kbps", ErrBadQuery, v)
+		}
+		t.op, t.num = op, int64(kbps)
+	default:
+		if _, ok := textFields[field]; !ok {
+			return t, fmt.Errorf("%w: no field %s", ErrBadQuery, field)
+		}
+	}
+
+	return t, nil
+}
+
+func parseOp(v string) (string, string) {
+	for _, op := range []string{"<=", ">=", "<", ">", "="} {
+		if strings.HasPrefix(v, op) {
+			return op, v[len(op):]
+		}
+	}
+
+	return "=", v
+}
+
+// A Go duration (2m30s) or minutes and seconds (2:30)
+func parseDuration(v string) (time.Duration, error) {
+	parts := strings.SplitN(v, ":", 2)
+	if len(parts) == 1 {
+		return time.ParseDuration(v)
+	}
+
+	m, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, err
+	}
+
+	s, err := strconv.Atoi(parts[1])
+	if err != nil || s >= 60 {
+		return 0, fmt.Errorf("bad seconds in %s", v)
+	}
+
+	return time.Duration(m)*time.Minute + time.Duration(s)*time.Second, nil
+}
+
+func (t term) match(song proto.Song) int {
+	switch t.field {
+	case "":
+		best := noMatch
+		for _, field := range []string{"title", "artist", "album", "name"} {
+			if m := matchText(textFields[field](song), t.text); m > best {
+				best = m
+			}
+		}
+		return best
+	case "hash":
+		if strings.HasPrefix(song.Hash, t.text) {
+			return exactMatch
+		}
+		return noMatch
+	case "duration": // = is to the second, as list-songs shows it
+		d := int64(song.Duration)
+		if t.op == "=" {
+			d = int64(song.Duration.Round(time.Second))
+		}
+		return compare(d, t.op, t.num)
+	case "bitrate":
+		return compare(int64(song.Bitrate), t.op, t.num)
+	default:
+		return matchText(textFields[t.field](song), t.text)
+	}
+}
+
+func compare(a int64, op string, b int64) int {
+	var ok bool
+	switch op {
+	case "<":
+		ok = a < b
+	case "<=":
+		ok = a <= b
+	case ">":
+		ok = a > b
+	case ">=":
+		ok = a >= b
+	default:
+		ok = a == b
+	}
+
+	if ok {
+		return exactMatch
+	}
+	return noMatch
+}
+
+func matchText(field string, text string) int {
+	field = strings.ToLower(field)
+	if strings.Contains(field, text) {
+		return exactMatch
+	}
+
+	if fuzzy(field, text) {
+		return fuzzyMatch
+	}
+
+	return noMatch
+}
+
+// Is some run of words in field within a typo per 4 letters of text
+func fuzzy(field string, text string) bool {
+	want := strings.FieldsFunc(text, notAlnum)
+	words := strings.FieldsFunc(field, notAlnum)
+	typos := len([]rune(strings.Join(want, " "))) / 4
+	if typos == 0 {
+		return false
+	}
+
+	for i := 0; i+len(want) <= len(words); i++ {
+		if distance(strings.Join(words[i:i+len(want)], " "), strings.Join(want, " ")) <= typos {
+			return true
+		}
+	}
+
+	return false
+}
+
+func notAlnum(r rune) bool {
+	return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+}
+
+// Edit distance between a and b, counting swapped neighbours as one typo
+func distance(a string, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	before := make([]int, len(rb)+1)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+			if i > 1 && j > 1 && ra[i-1] == rb[j-2] && ra[i-2] == rb[j-1] && before[j-2]+1 < cur[j] {
+				cur[j] = before[j-2] + 1
+			}
+		}
+		before, prev, cur = prev, cur, before
+	}
+
+	return prev[len(rb)]
+}
@@ -0,0 +1,1109 @@
+package trackerd
+
+import (
+	"fmt"
+	"math"
+	"mob/proto"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Where the tracker is in playing the song at the head of the queue
+type Phase int
+
+const (
+	Idle      Phase = iota // no song picked
+	Seeding                // peers told to seed or listen for the current song
+	Buffering              // some peers buffered enough, waiting on the rest
+	Playing                // start time handed out
+	Draining               // some peers done playing, waiting on the rest
+)
+
+var phaseNames = []string{"idle", "seeding", "buffering", "playing", "draining"}
+
+func (p Phase) String() string {
+	if p < 0 || int(p) >= len(phaseNames) {
+		return fmt.Sprintf("phase(%d)", int(p))
+	}
+
+	return phaseNames[p]
+}
+
+// Legal phase transitions. Anything else is a bug and is refused.
+var transitions = map[Phase][]Phase{
+	Idle:      {Seeding},
+	Seeding:   {Buffering, Idle},
+	Buffering: {Playing, Seeding, Idle},
+	Playing:   {Draining, Idle},
+	Draining:  {Idle},
+}
+
+// How often we broadcast the reference playback position
+const positionInterval = 2 * time.Second
+
+// Shortest hash prefix a song can be picked by
+const minHashPrefix = 6
+
+// Something we can make rpcs on; a *rpc2.Client in practice
+type Conn interface {
+	Call(method string, args interface{}, reply interface{}) error
+	Close() error
+}
+
+// What a peer should be told to do for the current song
+type Dispatch int
+
+const (
+	DispatchNone   Dispatch = iota
+	DispatchSeed            // has the song locally; seed it
+	DispatchListen          // doesn't; listen for mp3 frames
+)
+
+// A song in the queue and the peers' votes on it
+type entry struct {
+	song  proto.Song
+	owner string         // user that enqueued it
+	seq   uint64         // enqueue order; first come first served among equal scores
+	votes map[string]int // 1 up or -1 down, by peer id
+}
+
+// Votes on the song on balance
+func (e *entry) score() int {
+	score := 0
+	for _, v := range e.votes {
+		score += v
+	}
+
+	return score
+}
+
+type peer struct {
+	conn     Conn
+	lastSeen time.Time
+	clock    proto.ClockMsg
+	info     proto.ClientInfoMsg // what it joined with; its songs and ports
+	user     string              // who it is, the same across rejoins
+	ready    bool                // buffered enough of the current song
+	playing  bool                // counted in state.playing
+	position *proto.PositionMsg
+}
+
+// Everything the tracker knows, behind one mutex. Each rpc handler makes a
+// single call on the state, which moves the current song through its phases
+// and refuses (and logs) anything that doesn't make sense in the current one.
+// Rpcs to peers are never made while holding the lock.
+type state struct {
+	mu    sync.Mutex
+	phase Phase
+	peers map[string]*peer
+	conns map[Conn]string   // reverse lookup of peers
+	queue []*entry          // songs to be played; the head is the current song
+	seq   uint64            // entries enqueued so far
+	turns map[string]uint64 // which pick each user's last song was, to take turns by; kept when they leave
+	picks uint64            // songs picked off the queue so far
+
+	song      proto.Song      // the current song, zero while idle
+	startTime time.Time       // when everyone starts playing the current song
+	playing   int             // peers still playing the current song
+	skipVotes map[string]bool // peers that voted to skip the current song
+	aborting  bool            // peers still dropping a skipped song; hold the next one
+
+	readyTimer    *time.Timer
+	stopBroadcast chan struct{}
+
+	readyTimeout time.Duration // how long to wait for every peer to be ready
+	startDelay   time.Duration // how far in the future to schedule the start
+	skipShare    float64       // share of the peers whose votes skip the current song
+	fair         bool          // take turns between the peers' songs
+	maxQueued    int           // songs a peer may have up next; 0 is no limit
+
+	now  func() time.Time
+	logf func(format string, args ...interface{})
+}
+
+func newState(readyTimeout time.Duration, startDelay time.Duration, skipShare float64, fair bool, maxQueued int, logf func(string, ...interface{})) *state {
+	return &state{
+		peers:        make(map[string]*peer),
+		conns:        make(map[Conn]string),
+		queue:        make([]*entry, 0),
+		turns:        make(map[string]uint64),
+		skipVotes:    make(map[string]bool),
+		readyTimeout: readyTimeout,
+		startDelay:   startDelay,
+		skipShare:    skipShare,
+		fair:         fair,
+		maxQueued:    maxQueued,
+		now:          time.Now,
+		logf:         logf,
+	}
+}
+
+// Current phase
+func (s *state) Phase() Phase {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.phase
+}
+
+// Current song, zero while idle
+func (s *state) Song() proto.Song {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.song
+}
+
+// Register a peer, the songs it has and the ports it listens on
+func (s *state) Join(conn Conn, info proto.ClientInfoMsg) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := info.Ip
+	if old, ok := s.peers[id]; ok {
+		delete(s.conns, old.conn)
+	}
+
+	user := info.Id
+	if user == "" {
+		user = id
+	}
+
+	s.peers[id] = &peer{conn: conn, info: info, user: user, lastSeen: s.now()}
+	s.conns[conn] = id
+	s.logf("Accepted a new client: %s (%s)", id, user)
+}
+
+// A peer got new songs
+func (s *state) AddSongs(conn Conn, songs []proto.Song) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id, ok := s.conns[conn]
+	if !ok {
+		return
+	}
+
+	p := s.peers[id]
+	for _, song := range songs {
+		if !hasSong(p.info.Songs, song.Hash) {
+			p.info.Songs = append(p.info.Songs, song)
+		}
+	}
+}
+
+// A peer no longer has some of its songs. If it is seeding one of them
+// it carries on; it has the file open.
+func (s *state) RemoveSongs(conn Conn, songs []proto.Song) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id, ok := s.conns[conn]
+	if !ok {
+		return
+	}
+
+	p := s.peers[id]
+	kept := make([]proto.Song, 0, len(p.info.Songs))
+	for _, song := range p.info.Songs {
+		if !hasSong(songs, song.Hash) {
+			kept = append(kept, song)
+		}
+	}
+	p.info.Songs = kept
+}
+
+// The peer on the other end of conn leaving of its own accord. If the
+// current song is skipped without it, returns the song and the connections
+// to tell, as Skip does.
+func (s *state) Leave(conn Conn) (proto.Song, []Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id, ok := s.conns[conn]
+	if !ok {
+		return proto.Song{}, nil
+	}
+
+	_, song, conns := s.drop(id)
+	s.logf("Removing client %s", id)
+	return song, conns
+}
+
+// Drop a peer that crashed or lost connectivity, so that the song it was
+// part of isn't held up waiting on it. Returns its connection to close and,
+// if the current song is skipped without it, the song and the connections
+// to tell.
+func (s *state) Evict(id string, reason string) (Conn, proto.Song, []Conn, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, song, conns := s.drop(id)
+	if p == nil {
+		return nil, proto.Song{}, nil, false
+	}
+
+	s.logf("Evicting client %s: %s", id, reason)
+	return p.conn, song, conns, true
+}
+
+// Id of the peer on the other end of conn
+func (s *state) PeerId(conn Conn) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id, ok := s.conns[conn]
+	return id, ok
+}
+
+// Peers we haven't heard from in timeout
+func (s *state) IdlePeers(timeout time.Duration) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var idle []string
+	for id, p := range s.peers {
+		if s.now().Sub(p.lastSeen) > timeout {
+			idle = append(idle, id)
+		}
+	}
+
+	return idle
+}
+
+// Record a ping from the peer on the other end of conn and work out what it
+// should be doing about the current song. Picks the next song off the queue
+// when idle.
+func (s *state) Ping(conn Conn) (Dispatch, proto.Song) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id, ok := s.conns[conn]
+	if !ok {
+		return DispatchNone, proto.Song{}
+	}
+
+	p := s.peers[id]
+
+	p.lastSeen = s.now()
+
+	if s.aborting {
+		return DispatchNone, proto.Song{}
+	}
+
+	// Pass over songs that went away with the peers that had them
+	for s.phase == Idle && len(s.queue) > 0 && !hasSong(s.songs(), s.queue[0].song.Hash) {
+		s.logf("Skipping %s: no peer has it anymore", s.queue[0].song.Name)
+		s.queue = append(s.queue[:0], s.queue[1:]...)
+	}
+
+	if s.phase == Idle && len(s.queue) > 0 {
+		s.song = s.queue[0].song
+		s.transition(Seeding)
+
+		s.picks++
+		s.turns[s.queue[0].owner] = s.picks
+		s.sortQueue() // the others' turn now
+	}
+
+	switch s.phase {
+	case Seeding, Buffering, Playing:
+	default:
+		return DispatchNone, proto.Song{}
+	}
+
+	if hasSong(p.info.Songs, s.song.Hash) {
+		return DispatchSeed, s.song
+	}
+
+	return DispatchListen, s.song
+}
+
+// Add the song arg names to the queue for the peer on the other end of
+// conn: a hash, a unique prefix of one, or a file name only one song goes
+// by. It goes after the songs with no downvotes on balance, or in fair mode
+// after the peer's own such songs. A peer may have maxQueued songs up next.
+func (s *state) Enqueue(conn Conn, arg string) (proto.Song, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.user(conn)
+	if !ok {
+		return proto.Song{}, ErrNotJoined
+	}
+
+	song, err := s.lookup(arg)
+	if err != nil {
+		return proto.Song{}, err
+	}
+
+	if s.maxQueued > 0 {
+		n := 0
+		for _, e := range s.queue[s.upNext():] {
+			if e.owner == user {
+				n++
+			}
+		}
+
+		if n >= s.maxQueued {
+			return proto.Song{}, fmt.Errorf("%w: %d is the most", ErrQueueFull, s.maxQueued)
+		}
+	}
+
+	s.seq++
+	s.queue = append(s.queue, &entry{song, user, s.seq, make(map[string]int)})
+	s.sortQueue()
+	return song, nil
+}
+
+// The current song (zero while idle), the songs up next, their scores and
+// who enqueued them
+func (s *state) UpNext() proto.QueueList {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	next := s.queue[s.upNext():]
+	queue := proto.QueueList{s.song, songsOf(next), make([]int, len(next)), make([]string, len(next))}
+	for i, e := range next {
+		queue.Scores[i] = e.score()
+		queue.Owners[i] = e.owner
+	}
+
+	return queue
+}
+
+// Drop the song at pos among the songs up next, counting from 1. Only the
+// peer that enqueued it may.
+func (s *state) Remove(conn Conn, pos int) (proto.Song, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i, err := s.own(conn, pos)
+	if err != nil {
+		return proto.Song{}, err
+	}
+
+	e := s.queue[i]
+	s.queue = append(s.queue[:i], s.queue[i+1:]...)
+	return e.song, nil
+}
+
+// Move the song at pos among the songs up next to position to, where
+// another of the same peer's songs is, as if the peer had enqueued its
+// songs in their new order. Only the peer that enqueued both may, so
+// nobody can jump ahead of another peer's songs. Votes still come first,
+// so a song can't be moved past one with a different score.
+func (s *state) Move(conn Conn, pos int, to int) (proto.Song, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i, err := s.own(conn, pos)
+	if err != nil {
+		return proto.Song{}, err
+	}
+
+	j, err := s.own(conn, to)
+	if err != nil {
+		return proto.Song{}, err
+	}
+
+	e := s.queue[i]
+	s.queue = append(s.queue[:i], s.queue[i+1:]...)
+	s.queue = append(s.queue[:j], append([]*entry{e}, s.queue[j:]...)...)
+
+	// Hand the peer's enqueue order back out in the new order
+	var mine []*entry
+	for _, m := range s.queue[s.upNext():] {
+		if m.owner == e.owner {
+			mine = append(mine, m)
+		}
+	}
+	seqs := make([]uint64, len(mine))
+	for k, m := range mine {
+		seqs[k] = m.seq
+	}
+	sort.Slice(seqs, func(a, b int) bool { return seqs[a] < seqs[b] })
+	for k, m := range mine {
+		m.seq = seqs[k]
+	}
+
+	s.sortQueue()
+	return e.song, nil
+}
+
+// A peer's vote on the song at pos among the songs up next: 1 up or -1
+// down. A peer has one vote per song; voting again replaces it.
+func (s *state) Vote(conn Conn, pos int, vote int) (proto.Song, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id, ok := s.conns[conn]
+	if !ok {
+		return proto.Song{}, ErrNotJoined
+	}
+
+	i := s.upNext() + pos - 1
+	if pos < 1 || i >= len(s.queue) {
+		return proto.Song{}, ErrNoSuchEntry
+	}
+
+	e := s.queue[i]
+	e.votes[id] = vote
+	s.sortQueue()
+	return e.song, nil
+}
+
+// Drop every song up next the peer on the other end of conn enqueued,
+// returning them. The current song plays on.
+func (s *state) Clear(conn Conn) ([]proto.Song, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.user(conn)
+	if !ok {
+		return nil, ErrNotJoined
+	}
+
+	first := s.upNext()
+	kept := s.queue[:first]
+	var cleared []*entry
+	for _, e := range s.queue[first:] {
+		if e.owner == user {
+			cleared = append(cleared, e)
+		} else {
+			kept = append(kept, e)
+		}
+	}
+	s.queue = kept
+
+	return songsOf(cleared), nil
+}
+
+// Abandon the current song and go back to idle, so the next ping picks the
+// next one. Returns the song and every peer's connection, to tell them all
+// to drop it; even a peer we weren't waiting on may be relaying it.
+func (s *state) Skip() (proto.Song, []Conn, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.phase == Idle {
+		return proto.Song{}, nil, ErrNotPlaying
+	}
+
+	song := s.song
+	return song, s.skip(), nil
+}
+
+// A peer's vote to skip the current song. Once skipShare of the peers
+// voted, the song is skipped as by Skip, and the connections to tell are
+// returned.
+func (s *state) VoteSkip(conn Conn) (proto.SkipVote, []Conn, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id, ok := s.conns[conn]
+	if !ok {
+		return proto.SkipVote{}, nil, ErrNotJoined
+	}
+
+	if s.phase == Idle {
+		return proto.SkipVote{}, nil, ErrNotPlaying
+	}
+
+	s.skipVotes[id] = true
+	vote := proto.SkipVote{s.song, len(s.skipVotes), s.votesNeeded(), false}
+	if vote.Votes < vote.Needed {
+		s.logf("%s voted to skip %s (%d of %d)", id, s.song.Name, vote.Votes, vote.Needed)
+		return vote, nil, nil
+	}
+
+	vote.Skipped = true
+	return vote, s.skip(), nil
+}
+
+// Every peer dropped the song that was skipped (or we gave up waiting), so
+// the next one can be picked without any of them still busy with it
+func (s *state) Aborted() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.aborting = false
+}
+
+// A peer has buffered enough of the current song, by its hash, to start
+// playing. Once every peer is ready (or readyTimeout passes) we pick a
+// start time a little in the future and hand it to all of them at once.
+func (s *state) Ready(conn Conn, hash string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id, ok := s.conns[conn]
+	if !ok {
+		return
+	}
+
+	if hash != s.song.Hash { // a song that was skipped
+		s.logf("Ignoring ready-to-play from %s for another song", id)
+		return
+	}
+
+	p := s.peers[id]
+	if p.ready {
+		return
+	}
+
+	switch s.phase {
+	case Seeding:
+		s.transition(Buffering)
+	case Buffering:
+	case Playing, Draining: // too late, the song was already scheduled
+		p.ready = true
+		p.playing = true
+		s.playing++
+		go p.conn.Call("start-playing", proto.TimePacket{s.startTime}, nil)
+		return
+	default:
+		s.logf("Ignoring ready-to-play from %s while %s", id, s.phase)
+		return
+	}
+
+	p.ready = true
+	p.playing = true
+	s.playing++
+
+	if !s.checkReady() && s.readyTimer == nil {
+		song := s.song
+		s.readyTimer = time.AfterFunc(s.readyTimeout, func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if s.phase == Buffering && s.song == song {
+				s.schedule()
+			}
+		})
+	}
+}
+
+// A peer finished playing the current song, by its hash. On the last one,
+// we move on to the next song in the queue.
+func (s *state) Done(conn Conn, hash string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id, ok := s.conns[conn]
+	if !ok {
+		return
+	}
+
+	if hash != s.song.Hash {
+		s.logf("Ignoring done-playing from %s for another song", id)
+		return
+	}
+
+	p := s.peers[id]
+	if !p.playing || (s.phase != Playing && s.phase != Draining) {
+		s.logf("Ignoring done-playing from %s while %s", id, s.phase)
+		return
+	}
+
+	p.playing = false
+	s.finish()
+}
+
+// A peer reporting how far into the current song it is
+func (s *state) ReportPosition(conn Conn, pos proto.PositionMsg) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id, ok := s.conns[conn]
+	if !ok || pos.SongId != proto.SongId(s.song.Hash) {
+		return
+	}
+
+	s.peers[id].position = &pos
+}
+
+// A peer reporting how far its clock is off from ours
+func (s *state) ReportClock(conn Conn, msg proto.ClockMsg) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if id, ok := s.conns[conn]; ok {
+		s.peers[id].clock = msg
+	}
+}
+
+// Unique global list of songs
+func (s *state) Songs() []proto.Song {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.songs()
+}
+
+// Connected peers, their clock offsets and ports
+func (s *state) Peers() []proto.PeerInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	peers := make([]proto.PeerInfo, 0, len(s.peers))
+	for id, p := range s.peers {
+		peers = append(peers, proto.PeerInfo{id, p.clock.Offset, p.clock.RTT, p.info.HandshakePort, p.info.MediaPort})
+	}
+
+	return peers
+}
+
+// Copy of the song queue
+func (s *state) Queue() []proto.Song {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return songsOf(s.queue)
+}
+
+// Abandon the current song and forget every peer, returning their
+// connections to be closed
+func (s *state) shutdown() []Conn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	conns := make([]Conn, 0, len(s.peers))
+	for _, p := range s.peers {
+		conns = append(conns, p.conn)
+	}
+
+	s.peers = make(map[string]*peer)
+	s.conns = make(map[Conn]string)
+	if s.phase != Idle {
+		s.reset(false)
+	}
+
+	return conns
+}
+
+// Move to phase to, refusing transitions the phase table doesn't allow.
+// Must hold mu.
+func (s *state) transition(to Phase) bool {
+	for _, p := range transitions[s.phase] {
+		if p == to {
+			s.phase = to
+			return true
+		}
+	}
+
+	s.logf("Error: illegal transition %s -> %s", s.phase, to)
+	return false
+}
+
+// Schedule the start if every peer is ready. Must hold mu.
+func (s *state) checkReady() bool {
+	if s.phase != Buffering {
+		return false
+	}
+
+	ready := 0
+	for _, p := range s.peers {
+		if p.ready {
+			ready++
+		}
+	}
+
+	if ready == 0 {
+		s.stopReadyTimer()
+		s.transition(Seeding) // the only ready peers left
+		return false
+	}
+
+	if ready < len(s.peers) {
+		return false
+	}
+
+	s.schedule()
+	return true
+}
+
+// Tell every ready peer to start playing at the same moment. Must hold mu.
+func (s *state) schedule() {
+	if !s.transition(Playing) {
+		return
+	}
+
+	s.stopReadyTimer()
+	s.startTime = s.now().Add(s.startDelay)
+
+	n := 0
+	for _, p := range s.peers {
+		if p.ready {
+			// start-playing blocks for the whole song on the client
+			go p.conn.Call("start-playing", proto.TimePacket{s.startTime}, nil)
+			n++
+		}
+	}
+
+	s.logf("Starting %s for %d peers at %s", s.song.Name, n, s.startTime.Format("15:04:05.000"))
+
+	s.stopBroadcast = make(chan struct{})
+	go s.broadcastPositions(proto.SongId(s.song.Hash), s.stopBroadcast)
+}
+
+// Count one peer as done with the current song. Must hold mu.
+func (s *state) finish() {
+	s.playing--
+
+	if s.phase == Playing {
+		s.transition(Draining)
+	}
+
+	if s.playing == 0 {
+		s.reset(true)
+	}
+}
+
+// Back to idle. If played is set the current song is popped off the queue.
+// Must hold mu.
+func (s *state) reset(played bool) {
+	if !s.transition(Idle) {
+		return
+	}
+
+	if played && len(s.queue) > 0 {
+		s.queue = append(s.queue[:0], s.queue[1:]...)
+	}
+
+	s.stopReadyTimer()
+	if s.stopBroadcast != nil {
+		close(s.stopBroadcast)
+		s.stopBroadcast = nil
+	}
+
+	for _, p := range s.peers {
+		p.ready = false
+		p.playing = false
+		p.position = nil
+	}
+
+	s.song = proto.Song{}
+	s.startTime = time.Time{}
+	s.playing = 0
+	s.skipVotes = make(map[string]bool)
+}
+
+// Skip the current song: back to idle with it popped off the queue.
+// Returns every peer's connection. Must hold mu.
+func (s *state) skip() []Conn {
+	conns := make([]Conn, 0, len(s.peers))
+	for _, p := range s.peers {
+		conns = append(conns, p.conn)
+	}
+
+	s.logf("Skipping %s while %s", s.song.Name, s.phase)
+	s.reset(true)
+	s.aborting = true
+	return conns
+}
+
+// Skip votes it takes to skip the current song: more than skipShare of the
+// peers, so with the default of half no one peer of two can. Must hold mu.
+func (s *state) votesNeeded() int {
+	n := int(math.Floor(s.skipShare*float64(len(s.peers)))) + 1
+	if n > len(s.peers) {
+		n = len(s.peers)
+	}
+	if n < 1 {
+		n = 1
+	}
+
+	return n
+}
+
+// Who the peer on the other end of conn is. Must hold mu.
+func (s *state) user(conn Conn) (string, bool) {
+	id, ok := s.conns[conn]
+	if !ok {
+		return "", false
+	}
+
+	return s.peers[id].user, true
+}
+
+// Index in the queue of the song at pos among the songs up next, which the
+// peer on the other end of conn has to have enqueued. Must hold mu.
+func (s *state) own(conn Conn, pos int) (int, error) {
+	user, ok := s.user(conn)
+	if !ok {
+		return 0, ErrNotJoined
+	}
+
+	i := s.upNext() + pos - 1
+	if pos < 1 || i >= len(s.queue) {
+		return 0, ErrNoSuchEntry
+	}
+
+	if s.queue[i].owner != user {
+		return 0, ErrNotOwner
+	}
+
+	return i, nil
+}
+
+// Put the songs up next in order: most votes on balance first, then first
+// come first served. In fair mode that orders each peer's songs, and the
+// peers take turns: every peer's first song, then every peer's second, and
+// so on, the peer whose song played longest ago first. Must hold mu.
+func (s *state) sortQueue() {
+	next := s.queue[s.upNext():]
+	sort.SliceStable(next, func(i, j int) bool {
+		if a, b := next[i].score(), next[j].score(); a != b {
+			return a > b
+		}
+		return next[i].seq < next[j].seq
+	})
+
+	if !s.fair {
+		return
+	}
+
+	var owners []string
+	songs := make(map[string][]*entry)
+	waiting := make(map[string]uint64) // since the peer's earliest song
+	for _, e := range next {
+		if _, ok := songs[e.owner]; !ok {
+			owners = append(owners, e.owner)
+			waiting[e.owner] = e.seq
+		}
+		if e.seq < waiting[e.owner] {
+			waiting[e.owner] = e.seq
+		}
+		songs[e.owner] = append(songs[e.owner], e)
+	}
+
+	// Peers that never had a turn go first, longest waiting first
+	sort.Slice(owners, func(i, j int) bool {
+		a, b := owners[i], owners[j]
+		if s.turns[a] != s.turns[b] {
+			return s.turns[a] < s.turns[b]
+		}
+		return waiting[a] < waiting[b]
+	})
+
+	k := 0
+	for round := 0; k < len(next); round++ {
+		for _, owner := range owners {
+			if round < len(songs[owner]) {
+				next[k] = songs[owner][round]
+				k++
+			}
+		}
+	}
+}
+
+// Index of the first song up next in the queue; the head is the current
+// song unless we're idle. Must hold mu.
+func (s *state) upNext() int {
+	if s.phase == Idle {
+		return 0
+	}
+
+	return 1
+}
+
+func (s *state) stopReadyTimer() {
+	if s.readyTimer != nil {
+		s.readyTimer.Stop()
+		s.readyTimer = nil
+	}
+}
+
+// Forget about a peer and stop waiting on it for the current song. If it
+// had the only copy of a song that hasn't started, or the skip votes left
+// are now enough, the song is skipped and returned with every peer's
+// connection. Must hold mu.
+func (s *state) drop(id string) (*peer, proto.Song, []Conn) {
+	p, ok := s.peers[id]
+	if !ok {
+		return nil, proto.Song{}, nil
+	}
+
+	delete(s.peers, id)
+	delete(s.conns, p.conn)
+
+	// Votes go with the peer
+	delete(s.skipVotes, id)
+	for _, e := range s.queue {
+		delete(e.votes, id)
+	}
+	s.sortQueue()
+
+	switch s.phase {
+	case Buffering: // don't wait on it to get ready
+		if p.playing {
+			s.playing--
+		}
+		s.checkReady()
+	case Playing, Draining: // don't wait on it to finish playing
+		if p.playing {
+			s.finish()
+		}
+	}
+
+	if len(s.peers) == 0 && (s.phase == Seeding || s.phase == Buffering) {
+		s.reset(false) // nobody left; keep the song for whoever joins next
+	}
+
+	// Nobody left to seed it, so it would never get going
+	if (s.phase == Seeding || s.phase == Buffering) && !hasSong(s.songs(), s.song.Hash) {
+		s.logf("%s had the only copy of %s", id, s.song.Name)
+		song := s.song
+		return p, song, s.skip()
+	}
+
+	// Fewer peers need fewer votes; the ones in may be enough now
+	if s.phase != Idle && len(s.skipVotes) > 0 && len(s.skipVotes) >= s.votesNeeded() {
+		s.logf("%d of %d voted to skip %s", len(s.skipVotes), len(s.peers), s.song.Name)
+		song := s.song
+		return p, song, s.skip()
+	}
+
+	return p, proto.Song{}, nil
+}
+
+// Unique songs by hash, each under the first name a peer gave it.
+// Must hold mu.
+func (s *state) songs() []proto.Song {
+	encountered := map[string]bool{}
+	result := []proto.Song{}
+
+	for _, p := range s.peers {
+		for _, song := range p.info.Songs {
+			if !encountered[song.Hash] {
+				encountered[song.Hash] = true
+				result = append(result, song)
+			}
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Name != result[j].Name {
+			return result[i].Name < result[j].Name
+		}
+		return result[i].Hash < result[j].Hash
+	})
+
+	return result
+}
+
+// The one song arg names. Must hold mu.
+func (s *state) lookup(arg string) (proto.Song, error) {
+	byHash := map[string]proto.Song{}
+	byName := map[string]proto.Song{}
+
+	for _, p := range s.peers {
+		for _, song := range p.info.Songs {
+			if song.Hash == arg {
+				return song, nil
+			}
+
+			if len(arg) >= minHashPrefix && strings.HasPrefix(song.Hash, arg) {
+				byHash[song.Hash] = song
+			}
+
+			if song.Name == arg {
+				byName[song.Hash] = song
+			}
+		}
+	}
+
+	matches := byHash
+	if len(matches) == 0 {
+		matches = byName
+	}
+
+	switch len(matches) {
+	case 0:
+		return proto.Song{}, ErrNoSuchSong
+	case 1:
+		for _, song := range matches {
+			return song, nil
+		}
+	}
+
+	hashes := make([]string, 0, len(matches))
+	for _, song := range matches {
+		hashes = append(hashes, song.ShortHash())
+	}
+	sort.Strings(hashes)
+
+	return proto.Song{}, fmt.Errorf("%w: %s could be %s", ErrAmbiguousSong, arg, strings.Join(hashes, ", "))
+}
+
+func songsOf(entries []*entry) []proto.Song {
+	songs := make([]proto.Song, len(entries))
+	for i, e := range entries {
+		songs[i] = e.song
+	}
+
+	return songs
+}
+
+func hasSong(songs []proto.Song, hash string) bool {
+	for _, song := range songs {
+		if song.Hash == hash {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Keep every playing peer in step by periodically telling them where
+// the group as a whole is in the song; they correct their own drift
+func (s *state) broadcastPositions(songId uint32, stop chan struct{}) {
+	t := time.NewTicker(positionInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+
+		s.mu.Lock()
+		ref, ok := s.referencePosition(songId)
+		var conns []Conn
+		for _, p := range s.peers {
+			if p.playing {
+				conns = append(conns, p.conn)
+			}
+		}
+		s.mu.Unlock()
+
+		if !ok {
+			continue
+		}
+
+		for _, c := range conns {
+			go c.Call("sync-position", ref, nil)
+		}
+	}
+}
+
+// Median of the fresh position reports, each brought forward to now.
+// Taking the median rather than the time since the start means a group that
+// is uniformly a little late isn't made to skip; only outliers correct.
+// Must hold mu.
+func (s *state) referencePosition(songId uint32) (proto.PositionMsg, bool) {
+	now := s.now()
+
+	var pos []time.Duration
+	for _, p := range s.peers {
+		if p.position == nil || now.Sub(p.position.At) > 2*positionInterval {
+			continue // stale
+		}
+
+		pos = append(pos, p.position.Position+now.Sub(p.position.At))
+	}
+
+	if len(pos) == 0 {
+		return proto.PositionMsg{}, false
+	}
+
+	sort.Slice(pos, func(i, j int) bool { return pos[i] < pos[j] })
+	return proto.PositionMsg{"", songId, pos[len(pos)/2], now}, true
+}
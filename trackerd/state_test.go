@@ -0,0 +1,451 @@
+package trackerd
+
+import (
+	"errors"
+	"fmt"
+	"mob/proto"
+	"sync"
+	"testing"
+	"time"
+)
+
+var (
+	songA = proto.Song{Hash: "aaaaaaaaaaaa", Name: "a.mp3"}
+	songB = proto.Song{Hash: "bbbbbbbbbbbb", Name: "b.mp3"}
+)
+
+// A peer's end of the rpc connection; remembers what it was called on
+type fakeConn struct {
+	mu    sync.Mutex
+	calls []string
+}
+
+func (c *fakeConn) Call(method string, args interface{}, reply interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls = append(c.calls, method)
+	return nil
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+// Whether method was called on c within a second; some calls are made from
+// their own goroutine
+func (c *fakeConn) called(method string) bool {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		c.mu.Lock()
+		for _, m := range c.calls {
+			if m == method {
+				c.mu.Unlock()
+				return true
+			}
+		}
+		c.mu.Unlock()
+	}
+
+	return false
+}
+
+// A state with n peers, 10.0.0.1:1 to 10.0.0.n:1, of which only the first
+// has songA and songB, and the queue holding songA then songB. The clock
+// stands still, and the ready timeout never fires.
+type testState struct {
+	*state
+	t     *testing.T
+	ids   []string
+	conns []*fakeConn
+}
+
+func newTestState(t *testing.T, n int) *testState {
+	s := &testState{state: newState(time.Hour, 0, 0.5, false, 0, t.Logf), t: t}
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+
+	for i := 1; i <= n; i++ {
+		info := proto.ClientInfoMsg{Ip: fmt.Sprintf("10.0.0.%d:1", i)}
+		if i == 1 {
+			info.Songs = []proto.Song{songA, songB}
+		}
+
+		c := &fakeConn{}
+		s.Join(c, info)
+		s.ids = append(s.ids, info.Ip)
+		s.conns = append(s.conns, c)
+	}
+
+	for _, song := range []proto.Song{songA, songB} {
+		if _, err := s.Enqueue(s.conns[0], song.Name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Cleanup(func() { s.shutdown() }) // stops broadcasting positions
+	return s
+}
+
+// Drive songA to phase: every peer is told about it when seeding, the
+// first is ready when buffering, all are playing, and the first is done
+// when draining
+func (s *testState) advance(to Phase) {
+	s.t.Helper()
+
+	steps := []func(){
+		func() {
+			for _, c := range s.conns {
+				s.Ping(c)
+			}
+		},
+		func() { s.Ready(s.conns[0], songA.Hash) },
+		func() {
+			for _, c := range s.conns[1:] {
+				s.Ready(c, songA.Hash)
+			}
+		},
+		func() { s.Done(s.conns[0], songA.Hash) },
+	}
+
+	for i := 0; i < int(to); i++ {
+		steps[i]()
+	}
+
+	if s.Phase() != to || s.Song() != songA {
+		s.t.Fatalf("got %s %s, want %s %s", s.Phase(), s.Song().Name, to, songA.Name)
+	}
+}
+
+// Names of the songs up next
+func (s *testState) names() []string {
+	var names []string
+	for _, song := range s.UpNext().Songs {
+		names = append(names, song.Name)
+	}
+
+	return names
+}
+
+func TestSongGoesThroughEveryPhase(t *testing.T) {
+	s := newTestState(t, 2)
+
+	steps := []struct {
+		name string
+		do   func()
+		want Phase
+	}{
+		{"ping from a stranger", func() { s.Ping(&fakeConn{}) }, Idle},
+		{"ready while idle", func() { s.Ready(s.conns[0], songA.Hash) }, Idle},
+		{"seeder pings", func() {
+			if d, song := s.Ping(s.conns[0]); d != DispatchSeed || song != songA {
+				t.Errorf("seeder told %v %s", d, song.Name)
+			}
+		}, Seeding},
+		{"other peer pings", func() {
+			if d, song := s.Ping(s.conns[1]); d != DispatchListen || song != songA {
+				t.Errorf("other peer told %v %s", d, song.Name)
+			}
+		}, Seeding},
+		{"done before playing", func() { s.Done(s.conns[0], songA.Hash) }, Seeding},
+		{"ready for another song", func() { s.Ready(s.conns[0], songB.Hash) }, Seeding},
+		{"first ready", func() { s.Ready(s.conns[0], songA.Hash) }, Buffering},
+		{"first ready again", func() { s.Ready(s.conns[0], songA.Hash) }, Buffering},
+		{"everyone ready", func() { s.Ready(s.conns[1], songA.Hash) }, Playing},
+		{"done with another song", func() { s.Done(s.conns[0], songB.Hash) }, Playing},
+		{"first done", func() { s.Done(s.conns[0], songA.Hash) }, Draining},
+		{"first done again", func() { s.Done(s.conns[0], songA.Hash) }, Draining},
+		{"everyone done", func() { s.Done(s.conns[1], songA.Hash) }, Idle},
+		{"next song picked", func() { s.Ping(s.conns[1]) }, Seeding},
+	}
+
+	for _, step := range steps {
+		step.do()
+		if got := s.Phase(); got != step.want {
+			t.Fatalf("%s: %s, want %s", step.name, got, step.want)
+		}
+	}
+
+	if s.Song() != songB {
+		t.Errorf("playing %s after %s, want %s", s.Song().Name, songA.Name, songB.Name)
+	}
+
+	for i, c := range s.conns {
+		if !c.called("start-playing") {
+			t.Errorf("peer %d never told to start playing", i)
+		}
+	}
+}
+
+func TestIllegalTransitionsAreRefused(t *testing.T) {
+	legal := map[[2]Phase]bool{
+		{Idle, Seeding}:      true,
+		{Seeding, Buffering}: true,
+		{Seeding, Idle}:      true,
+		{Buffering, Playing}: true,
+		{Buffering, Seeding}: true,
+		{Buffering, Idle}:    true,
+		{Playing, Draining}:  true,
+		{Playing, Idle}:      true,
+		{Draining, Idle}:     true,
+	}
+
+	for from := Idle; from <= Draining; from++ {
+		for to := Idle; to <= Draining; to++ {
+			s := newState(time.Hour, 0, 0.5, false, 0, t.Logf)
+			s.phase = from
+
+			want := legal[[2]Phase{from, to}]
+			if got := s.transition(to); got != want {
+				t.Errorf("%s -> %s allowed %v, want %v", from, to, got, want)
+			}
+
+			if !want && s.phase != from {
+				t.Errorf("refused %s -> %s but moved to %s", from, to, s.phase)
+			}
+		}
+	}
+}
+
+func TestEvictionInEachPhase(t *testing.T) {
+	tests := []struct {
+		name    string
+		phase   Phase
+		evict   int // which peer
+		want    Phase
+		skipped bool
+		popped  bool // songA is off the queue
+	}{
+		{"listener while seeding", Seeding, 2, Seeding, false, false},
+		{"seeder while seeding", Seeding, 0, Idle, true, true},
+		{"unready peer while buffering", Buffering, 2, Buffering, false, false},
+		{"seeder while buffering", Buffering, 0, Idle, true, true},
+		{"listener while playing", Playing, 2, Draining, false, false},
+		{"seeder while playing", Playing, 0, Draining, false, false},
+		{"listener while draining", Draining, 2, Draining, false, false},
+		{"seeder while draining", Draining, 0, Draining, false, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestState(t, 3)
+			s.advance(test.phase)
+
+			conn, song, conns, ok := s.Evict(s.ids[test.evict], "test")
+			if !ok || conn != s.conns[test.evict] {
+				t.Fatalf("evicted %v, %v", conn, ok)
+			}
+
+			if got := s.Phase(); got != test.want {
+				t.Errorf("%s after evicting, want %s", got, test.want)
+			}
+
+			if skipped := song == songA; skipped != test.skipped || (skipped && len(conns) != 2) {
+				t.Errorf("skipped %q telling %d peers, want skipped %v", song.Name, len(conns), test.skipped)
+			}
+
+			queue := s.Queue()
+			if popped := queue[0] != songA; popped != test.popped {
+				t.Errorf("queue %v, want songA popped %v", queue, test.popped)
+			}
+
+			if _, _, _, ok := s.Evict(s.ids[test.evict], "again"); ok {
+				t.Error("evicted the same peer twice")
+			}
+		})
+	}
+}
+
+func TestEvictionLetsTheRestGoOn(t *testing.T) {
+	tests := []struct {
+		name  string
+		phase Phase
+		do    func(s *testState)
+		want  Phase
+		head  proto.Song // of the queue after
+	}{
+		// The one peer not ready yet goes, so the rest start
+		{"buffering", Buffering, func(s *testState) {
+			s.Ready(s.conns[1], songA.Hash)
+			s.Evict(s.ids[2], "test")
+		}, Playing, songA},
+		// The peers left playing finish
+		{"playing", Playing, func(s *testState) {
+			s.Evict(s.ids[2], "test")
+			s.Done(s.conns[0], songA.Hash)
+			s.Done(s.conns[1], songA.Hash)
+		}, Idle, songB},
+		{"draining", Draining, func(s *testState) {
+			s.Evict(s.ids[1], "test")
+			s.Evict(s.ids[2], "test")
+		}, Idle, songB},
+		// Nobody left; the song waits for whoever joins next
+		{"everyone while seeding", Seeding, func(s *testState) {
+			for _, id := range s.ids[1:] {
+				s.Evict(id, "test")
+			}
+			s.Leave(s.conns[0])
+		}, Idle, songA},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestState(t, 3)
+			s.advance(test.phase)
+			test.do(s)
+
+			if got := s.Phase(); got != test.want {
+				t.Errorf("%s, want %s", got, test.want)
+			}
+
+			if q := s.Queue(); len(q) == 0 || q[0] != test.head {
+				t.Errorf("queue %v, want %s first", q, test.head.Name)
+			}
+		})
+	}
+}
+
+func TestSkipInEachPhase(t *testing.T) {
+	for _, phase := range []Phase{Seeding, Buffering, Playing, Draining} {
+		t.Run(phase.String(), func(t *testing.T) {
+			s := newTestState(t, 2)
+			s.advance(phase)
+
+			song, conns, err := s.Skip()
+			if err != nil || song != songA || len(conns) != 2 {
+				t.Fatalf("skipped %s telling %d peers: %v", song.Name, len(conns), err)
+			}
+
+			if s.Phase() != Idle || s.Song() != (proto.Song{}) {
+				t.Fatalf("%s %s after skipping", s.Phase(), s.Song().Name)
+			}
+
+			// The next song waits until the peers dropped this one
+			if d, _ := s.Ping(s.conns[0]); d != DispatchNone || s.Phase() != Idle {
+				t.Fatalf("told %v while aborting", d)
+			}
+
+			s.Aborted()
+			if d, song := s.Ping(s.conns[0]); d != DispatchSeed || song != songB {
+				t.Fatalf("told %v %s after aborting", d, song.Name)
+			}
+
+			// Late word about the skipped song changes nothing
+			s.Ready(s.conns[1], songA.Hash)
+			s.Done(s.conns[1], songA.Hash)
+			if s.Phase() != Seeding {
+				t.Errorf("%s after late rpcs about %s", s.Phase(), songA.Name)
+			}
+		})
+	}
+
+	s := newTestState(t, 1)
+	if _, _, err := s.Skip(); !errors.Is(err, ErrNotPlaying) {
+		t.Errorf("skipped while idle: %v", err)
+	}
+}
+
+func TestVotesNeeded(t *testing.T) {
+	tests := []struct {
+		share float64
+		peers int
+		want  int
+	}{
+		{0.5, 1, 1},
+		{0.5, 2, 2},
+		{0.5, 3, 2},
+		{0.5, 4, 3},
+		{0.5, 5, 3},
+		{0, 3, 1},
+		{0.34, 3, 2},
+		{1, 3, 3},
+		{2, 3, 3},
+	}
+
+	for _, test := range tests {
+		s := newTestState(t, test.peers)
+		s.skipShare = test.share
+		if got := s.votesNeeded(); got != test.want {
+			t.Errorf("%v of %d peers: %d votes, want %d", test.share, test.peers, got, test.want)
+		}
+	}
+}
+
+func TestSkipVotes(t *testing.T) {
+	tests := []struct {
+		name    string
+		peers   int
+		voters  []int
+		leaving int // -1 for none
+		skipped bool
+	}{
+		{"one of two", 2, []int{0}, -1, false},
+		{"two of two", 2, []int{0, 1}, -1, true},
+		{"same peer twice", 3, []int{1, 1}, -1, false},
+		{"two of three", 3, []int{1, 2}, -1, true},
+		{"two of four", 4, []int{0, 1}, -1, false},
+		{"two of four, then a third leaves", 4, []int{0, 1}, 2, true},
+		{"two of four, then a voter leaves", 4, []int{0, 1}, 1, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestState(t, test.peers)
+			s.advance(Playing)
+
+			skipped := false
+			for _, i := range test.voters {
+				vote, _, err := s.VoteSkip(s.conns[i])
+				if err != nil {
+					t.Fatal(err)
+				}
+				skipped = skipped || vote.Skipped
+			}
+
+			if test.leaving >= 0 {
+				song, _ := s.Leave(s.conns[test.leaving])
+				skipped = skipped || song == songA
+			}
+
+			if skipped != test.skipped || (s.Phase() == Idle) != test.skipped {
+				t.Errorf("skipped %v and %s, want skipped %v", skipped, s.Phase(), test.skipped)
+			}
+		})
+	}
+}
+
+func TestOnlyOwnersManageTheirSongs(t *testing.T) {
+	s := newTestState(t, 2)
+
+	if _, err := s.Remove(s.conns[1], 1); !errors.Is(err, ErrNotOwner) {
+		t.Errorf("removed another peer's song: %v", err)
+	}
+	if _, err := s.Move(s.conns[1], 2, 1); !errors.Is(err, ErrNotOwner) {
+		t.Errorf("moved another peer's song: %v", err)
+	}
+	if cleared, err := s.Clear(s.conns[1]); err != nil || len(cleared) != 0 {
+		t.Errorf("cleared %v: %v", cleared, err)
+	}
+	if _, err := s.Remove(s.conns[0], 3); !errors.Is(err, ErrNoSuchEntry) {
+		t.Errorf("removed past the end: %v", err)
+	}
+	if _, err := s.Remove(&fakeConn{}, 1); !errors.Is(err, ErrNotJoined) {
+		t.Errorf("removed without joining: %v", err)
+	}
+
+	if _, err := s.Move(s.conns[0], 2, 1); err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(s.names()); got != "[b.mp3 a.mp3]" {
+		t.Errorf("queue %s after moving", got)
+	}
+}
+
+func TestIdlePeersAreFound(t *testing.T) {
+	s := newTestState(t, 2)
+	now := s.now()
+	s.now = func() time.Time { return now.Add(2 * time.Second) }
+	s.Ping(s.conns[1])
+
+	if idle := s.IdlePeers(time.Second); len(idle) != 1 || idle[0] != s.ids[0] {
+		t.Errorf("idle peers %v, want [%s]", idle, s.ids[0])
+	}
+}
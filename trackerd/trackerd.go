@@ -0,0 +1,506 @@
+// Package trackerd is a mob tracker: it keeps the list of peers and their
+// songs, queues songs up and tells the peers when to seed and play them.
+package trackerd
+
+import (
+	"errors"
+	"fmt"
+	"mob/proto"
+	"net"
+	"sync"
+	"time"
+	"github.com/cenkalti/rpc2"
+)
+
+var (
+	ErrClosed        = errors.New("trackerd: tracker closed")
+	ErrNoSuchSong    = errors.New("trackerd: no peer has that song")
+	ErrAmbiguousSong = errors.New("trackerd: several songs go by that name")
+	ErrBadQuery      = errors.New("trackerd: bad search query")
+	ErrNoSuchEntry   = errors.New("trackerd: no song at that queue position")
+	ErrNotPlaying    = errors.New("trackerd: no song is playing")
+	ErrNotJoined     = errors.New("trackerd: peer hasn't joined")
+	ErrQueueFull     = errors.New("trackerd: too many songs up next from that peer")
+	ErrNotOwner      = errors.New("trackerd: another peer enqueued that song")
+)
+
+// How long the next song waits on the peers to drop a skipped one
+const abortTimeout = time.Second
+
+type Config struct {
+	PeerTimeout  time.Duration // evict peers we haven't heard from in this long
+	ReadyTimeout time.Duration // how long to wait for every peer to be ready
+	StartDelay   time.Duration // how far in the future to schedule the start
+	Name         string        // what we go by in discovery answers
+	SkipVotes    float64       // more than this share of the peers must vote to skip the current song
+	FairQueue    bool          // take turns between the peers' songs rather than first come first served
+	MaxQueued    int           // songs a peer may have up next; 0 is no limit
+
+	// Where the tracker logs to; stdout if nil
+	Logf func(format string, args ...interface{})
+}
+
+// The settings the tracker starts with
+func DefaultConfig() Config {
+	return Config{
+		PeerTimeout:  5 * time.Second,
+		ReadyTimeout: 10 * time.Second,
+		StartDelay:   time.Second,
+		SkipVotes:    0.5,
+	}
+}
+
+type Tracker struct {
+	cfg   Config
+	srv   *rpc2.Server
+	state *state
+
+	mu         sync.Mutex // guards the four below
+	listeners  map[net.Listener]bool
+	announcers map[net.PacketConn]bool
+	conns      map[net.Conn]bool
+	closed     bool
+
+	done chan struct{} // closed on Close
+}
+
+// Zero settings in cfg take their defaults
+func New(cfg Config) *Tracker {
+	def := DefaultConfig()
+	if cfg.PeerTimeout <= 0 {
+		cfg.PeerTimeout = def.PeerTimeout
+	}
+	if cfg.ReadyTimeout <= 0 {
+		cfg.ReadyTimeout = def.ReadyTimeout
+	}
+	if cfg.StartDelay < 0 {
+		cfg.StartDelay = def.StartDelay
+	}
+	if cfg.SkipVotes <= 0 {
+		cfg.SkipVotes = def.SkipVotes
+	}
+	if cfg.MaxQueued < 0 {
+		cfg.MaxQueued = def.MaxQueued
+	}
+
+	if cfg.Logf == nil {
+		cfg.Logf = func(format string, args ...interface{}) {
+			fmt.Printf(format+"\n", args...)
+		}
+	}
+
+	t := &Tracker{
+		cfg:        cfg,
+		srv:        rpc2.NewServer(),
+		state:      newState(cfg.ReadyTimeout, cfg.StartDelay, cfg.SkipVotes, cfg.FairQueue, cfg.MaxQueued, cfg.Logf),
+		listeners:  make(map[net.Listener]bool),
+		announcers: make(map[net.PacketConn]bool),
+		conns:      make(map[net.Conn]bool),
+		done:       make(chan struct{}),
+	}
+
+	t.register()
+	go t.evictIdlePeers()
+	return t
+}
+
+// Accept peers on ln until it fails or the tracker is closed.
+// May be called for several listeners at once.
+func (t *Tracker) Serve(ln net.Listener) error {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return ErrClosed
+	}
+	t.listeners[ln] = true
+	t.mu.Unlock()
+
+	defer func() {
+		t.mu.Lock()
+		delete(t.listeners, ln)
+		t.mu.Unlock()
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if t.isClosed() {
+				return ErrClosed
+			}
+			return err
+		}
+
+		if !t.track(conn) {
+			conn.Close()
+			return ErrClosed
+		}
+
+		go func() {
+			t.srv.ServeConn(conn)
+			t.untrack(conn)
+		}()
+	}
+}
+
+// Answer discovery probes that arrive on pc with our name, peer count and
+// the port we Serve peers on, until pc fails or the tracker is closed.
+// pc should be bound to proto.DiscoveryPort on every interface to hear
+// broadcasts.
+func (t *Tracker) Announce(pc net.PacketConn) error {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return ErrClosed
+	}
+	t.announcers[pc] = true
+	t.mu.Unlock()
+
+	defer func() {
+		t.mu.Lock()
+		delete(t.announcers, pc)
+		t.mu.Unlock()
+	}()
+
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if t.isClosed() {
+				return ErrClosed
+			}
+			return err
+		}
+
+		if !proto.IsDiscoveryProbe(buf[:n]) {
+			continue
+		}
+
+		port := t.port()
+		if port == 0 { // not serving yet
+			continue
+		}
+
+		a := proto.TrackerAnnouncement{t.cfg.Name, port, len(t.state.Peers())}
+		pc.WriteTo(a.Encode(), addr)
+	}
+}
+
+// Stop listening, hang up on every peer and abandon the current song
+func (t *Tracker) Close() error {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return ErrClosed
+	}
+
+	t.closed = true
+	close(t.done)
+	for ln := range t.listeners {
+		ln.Close()
+	}
+	for pc := range t.announcers {
+		pc.Close()
+	}
+	t.mu.Unlock()
+
+	for _, c := range t.state.shutdown() {
+		c.Close()
+	}
+
+	// and whoever connected without joining
+	t.mu.Lock()
+	for c := range t.conns {
+		c.Close()
+	}
+	t.mu.Unlock()
+
+	return nil
+}
+
+// Where the tracker is in playing the current song
+func (t *Tracker) Phase() Phase {
+	return t.state.Phase()
+}
+
+// Current song, zero while idle
+func (t *Tracker) Song() proto.Song {
+	return t.state.Song()
+}
+
+// Unique global list of songs
+func (t *Tracker) Songs() []proto.Song {
+	return t.state.Songs()
+}
+
+// Songs matching a search query, best matches first
+func (t *Tracker) Search(query string) ([]proto.Song, error) {
+	return search(t.state.Songs(), query)
+}
+
+// Connected peers, their clock offsets and ports
+func (t *Tracker) Peers() []proto.PeerInfo {
+	return t.state.Peers()
+}
+
+// Songs to be played; the head is the current song
+func (t *Tracker) Queue() []proto.Song {
+	return t.state.Queue()
+}
+
+// Abandon the current song, telling every peer to drop it, and move on to
+// the next one, whatever the peers voted. Returns the skipped song.
+func (t *Tracker) Skip() (proto.Song, error) {
+	song, conns, err := t.state.Skip()
+	t.abort(song, conns)
+	return song, err
+}
+
+// Register our tracker rpcs
+func (t *Tracker) register() {
+	srv, state := t.srv, t.state
+
+	// join the peer network
+	srv.Handle("join", func(client *rpc2.Client, args *proto.ClientInfoMsg, reply *proto.TrackerRes) error {
+		state.Join(client, *args)
+		return nil
+	})
+
+	// A peer's songs directory changed
+	srv.Handle("add-songs", func(client *rpc2.Client, args *proto.ClientInfoMsg, reply *proto.TrackerRes) error {
+		state.AddSongs(client, args.Songs)
+		return nil
+	})
+
+	srv.Handle("remove-songs", func(client *rpc2.Client, args *proto.ClientInfoMsg, reply *proto.TrackerRes) error {
+		state.RemoveSongs(client, args.Songs)
+		return nil
+	})
+
+	// Return list of songs available to be played
+	srv.Handle("list-songs", func(client *rpc2.Client, args *proto.ClientCmdMsg, reply *proto.SongList) error {
+		reply.Songs = state.Songs()
+		return nil
+	})
+
+	// Return the songs matching a query, i.e. artist:vivaldi duration:<5m
+	srv.Handle("search", func(client *rpc2.Client, args *proto.ClientCmdMsg, reply *proto.SongList) error {
+		songs, err := t.Search(args.Arg)
+		reply.Songs = songs
+		return err
+	})
+
+	// Return list of peers connected to tracker, with their clock offsets and ports
+	srv.Handle("list-peers", func(client *rpc2.Client, args *proto.ClientCmdMsg, reply *proto.PeerList) error {
+		reply.Peers = state.Peers()
+		return nil
+	})
+
+	// Timestamp a clock sync request from a client (Cristian's algorithm / NTP)
+	srv.Handle("time-sync", func(client *rpc2.Client, args *proto.TimeSyncPacket, reply *proto.TimeSyncPacket) error {
+		reply.TrackerRecv = time.Now()
+		reply.ClientSend = args.ClientSend
+		reply.TrackerSend = time.Now()
+		return nil
+	})
+
+	// A client reporting how far its clock is off from ours
+	srv.Handle("clock-offset", func(client *rpc2.Client, args *proto.ClockMsg, reply *proto.TrackerRes) error {
+		state.ReportClock(client, *args)
+		return nil
+	})
+
+	// Enqueue song into song queue, by hash or name
+	srv.Handle("play", func(client *rpc2.Client, args *proto.ClientCmdMsg, reply *proto.Song) error {
+		song, err := state.Enqueue(client, args.Arg)
+		*reply = song
+		return err
+	})
+
+	// The current song and the songs up next
+	srv.Handle("queue", func(client *rpc2.Client, args *proto.ClientCmdMsg, reply *proto.QueueList) error {
+		*reply = state.UpNext()
+		return nil
+	})
+
+	// Drop a song up next the client enqueued
+	srv.Handle("remove", func(client *rpc2.Client, args *proto.QueueCmdMsg, reply *proto.Song) error {
+		song, err := state.Remove(client, args.Pos)
+		*reply = song
+		return err
+	})
+
+	// Move a song up next the client enqueued to where another of its songs is
+	srv.Handle("move", func(client *rpc2.Client, args *proto.QueueCmdMsg, reply *proto.Song) error {
+		song, err := state.Move(client, args.Pos, args.To)
+		*reply = song
+		return err
+	})
+
+	// Drop every song up next the client enqueued; the current one plays on
+	srv.Handle("clear", func(client *rpc2.Client, args *proto.ClientCmdMsg, reply *proto.SongList) error {
+		songs, err := state.Clear(client)
+		reply.Songs = songs
+		return err
+	})
+
+	// Vote to skip the current song; enough votes abandon it on every peer
+	srv.Handle("skip", func(client *rpc2.Client, args *proto.ClientCmdMsg, reply *proto.SkipVote) error {
+		vote, conns, err := state.VoteSkip(client)
+		t.abort(vote.Song, conns)
+		*reply = vote
+		return err
+	})
+
+	// Vote a song up next up (1) or down (-1)
+	srv.Handle("vote", func(client *rpc2.Client, args *proto.VoteMsg, reply *proto.Song) error {
+		if args.Vote != 1 && args.Vote != -1 {
+			return fmt.Errorf("trackerd: a vote is 1 or -1, not %d", args.Vote)
+		}
+
+		song, err := state.Vote(client, args.Pos, args.Vote)
+		*reply = song
+		return err
+	})
+
+	srv.Handle("leave", func(client *rpc2.Client, args *proto.ClientInfoMsg, reply *proto.TrackerRes) error {
+		t.abort(state.Leave(client))
+		return nil
+	})
+
+	// Contact peers with the song locally to start seeding
+	// Clients ask tracker when they can start seeding and when they can start
+	// playing the buffered mp3 frames
+	srv.Handle("ping", func(client *rpc2.Client, args *proto.ClientInfoMsg, reply *proto.TrackerRes) error {
+		// Dispatch call to seeder or call to non-seeder
+		switch d, song := state.Ping(client); d {
+		case DispatchSeed: // contact source seeders to start seeding
+			client.Call("seed", song, nil)
+		case DispatchListen: // contact non-source-seeders to listen for mp3 packets
+			client.Call("listen-for-mp3", song, nil)
+		}
+
+		return nil
+	})
+
+	// Notify the tracker that the client ready to start playing the song,
+	// by its hash
+	srv.Handle("ready-to-play", func(client *rpc2.Client, args *proto.ClientCmdMsg, reply *proto.TrackerRes) error {
+		state.Ready(client, args.Arg)
+		return nil
+	})
+
+	// A client reporting how far into the current song it is
+	srv.Handle("position", func(client *rpc2.Client, args *proto.PositionMsg, reply *proto.TrackerRes) error {
+		state.ReportPosition(client, *args)
+		return nil
+	})
+
+	// Notify the tracker that the client is done playing the audio for the mp3
+	srv.Handle("done-playing", func(client *rpc2.Client, args *proto.ClientCmdMsg, reply *proto.TrackerRes) error {
+		state.Done(client, args.Arg)
+		return nil
+	})
+
+	// A client that hangs up without leaving is gone for good
+	srv.OnDisconnect(func(client *rpc2.Client) {
+		if ip, ok := state.PeerId(client); ok {
+			t.evictPeer(ip, "disconnected")
+		}
+	})
+}
+
+// Periodically evict peers that stopped pinging us
+func (t *Tracker) evictIdlePeers() {
+	tick := time.NewTicker(t.cfg.PeerTimeout / 4)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-t.done:
+			return
+		case <-tick.C:
+		}
+
+		for _, ip := range t.state.IdlePeers(t.cfg.PeerTimeout) {
+			t.evictPeer(ip, "timed out")
+		}
+	}
+}
+
+// Drop a peer that crashed or lost connectivity, so that the song it was
+// part of isn't held up waiting on it
+func (t *Tracker) evictPeer(ip string, reason string) {
+	conn, song, conns, ok := t.state.Evict(ip, reason)
+	if ok {
+		conn.Close()
+	}
+
+	t.abort(song, conns)
+}
+
+// Tell the peers on conns to drop a song that was skipped. The next song
+// waits until they all have, or abortTimeout passes, so that none of them
+// turns it down for still being busy with this one.
+func (t *Tracker) abort(song proto.Song, conns []Conn) {
+	if conns == nil { // not skipped
+		return
+	}
+
+	done := make(chan struct{}, len(conns))
+	for _, c := range conns {
+		go func(c Conn) {
+			c.Call("abort", song, nil)
+			done <- struct{}{}
+		}(c)
+	}
+
+	timeout := time.After(abortTimeout)
+wait:
+	for range conns {
+		select {
+		case <-done:
+		case <-timeout:
+			break wait
+		}
+	}
+
+	t.state.Aborted()
+}
+
+// Port of one of the listeners we Serve on, 0 if none
+func (t *Tracker) port() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for ln := range t.listeners {
+		if addr, ok := ln.Addr().(*net.TCPAddr); ok {
+			return addr.Port
+		}
+	}
+
+	return 0
+}
+
+func (t *Tracker) track(c net.Conn) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return false
+	}
+
+	t.conns[c] = true
+	return true
+}
+
+func (t *Tracker) untrack(c net.Conn) {
+	t.mu.Lock()
+	delete(t.conns, c)
+	t.mu.Unlock()
+}
+
+func (t *Tracker) isClosed() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.closed
+}